@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jeroenrinzema/psql-wire/codes"
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+)
+
+// apiErrorCodes maps the error types of the Logfire API to the SQLSTATE codes reported to clients.
+var apiErrorCodes = map[string]codes.Code{
+	"syntax_error":       codes.Syntax,
+	"undefined_table":    codes.UndefinedTable,
+	"undefined_column":   codes.UndefinedColumn,
+	"undefined_function": codes.UndefinedFunction,
+	"permission_denied":  codes.InsufficientPrivilege,
+	"unauthorized":       codes.InvalidAuthorizationSpecification,
+	"quota_exceeded":     codes.ProgramLimitExceeded,
+	"rate_limited":       codes.ConfigurationLimitExceeded,
+	"timeout":            codes.QueryCanceled,
+}
+
+// apiErrorBody is the JSON body of an error response of the Logfire API. Errors carry either a type
+// and message, or only a detail as returned by FastAPI.
+type apiErrorBody struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+	Detail  any    `json:"detail"`
+}
+
+// parseAPIError returns the error type and message of the given error response body. The message is
+// the raw body if it is not JSON.
+func parseAPIError(body string) (errorType, message string) {
+	body = strings.TrimSpace(body)
+
+	var parsed apiErrorBody
+	if err := json.Unmarshal([]byte(body), &parsed); err != nil {
+		return "", body
+	}
+
+	switch detail := parsed.Detail.(type) {
+	case nil:
+	case string:
+		message = detail
+	default:
+		// Validation errors have a list of details, which are best shown as they are
+		message = body
+	}
+	if parsed.Message != "" {
+		message = parsed.Message
+	}
+	if message == "" {
+		message = body
+	}
+
+	return parsed.Error, message
+}
+
+// clientError returns the error reported to clients for a non-200 response of the Logfire API. The
+// message of the API is sent as the DETAIL, with a SQLSTATE code matching the type of the error.
+func (e *queryError) clientError() error {
+	errorType, message := parseAPIError(e.Body)
+
+	if e.StatusCode == http.StatusTooManyRequests {
+		retry := "try again later"
+		if e.RetryAfter > 0 {
+			retry = fmt.Sprintf("try again in %s", e.RetryAfter)
+		}
+		// The session is kept open, as the same query may well succeed once the limit is lifted
+		err := psqlerr.WithDetail(fmt.Errorf("query rate limited by Logfire, %s", retry), message)
+		return psqlerr.WithSeverity(psqlerr.WithCode(err, codes.OperatorIntervention), psqlerr.LevelError)
+	}
+
+	code, ok := apiErrorCodes[errorType]
+	if !ok {
+		code = codes.SyntaxErrorOrAccessRuleViolation
+	}
+
+	// Clients such as psql print the DETAIL on a line of its own, which keeps long API errors readable
+	err := psqlerr.WithDetail(fmt.Errorf("query failed: Logfire responded with status code %d", e.StatusCode), message)
+	return psqlerr.WithSeverity(psqlerr.WithCode(err, code), psqlerr.LevelFatal)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditEntry is a single line of the audit log, written for every statement received from clients.
+type auditEntry struct {
+	Timestamp time.Time `json:"ts"`
+	Remote    string    `json:"remote"`
+	User      string    `json:"user"`
+	SQL       string    `json:"sql"`
+	// Forwarded is whether the statement was sent to Logfire, rather than answered or rejected by
+	// logfire-pg itself. Rows are only counted for forwarded statements.
+	Forwarded  bool   `json:"forwarded"`
+	Rows       int    `json:"rows"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// auditLog appends audit entries as JSON lines to a file. The file is rotated at midnight and once it
+// grows beyond maxBytes, keeping the previous file next to it with a timestamp suffix.
+type auditLog struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	file     *os.File
+	size     int64
+	opened   time.Time
+}
+
+// openAuditLog opens the audit log at the given path, appending to it if it already exists.
+func openAuditLog(path string, maxBytes int64) (*auditLog, error) {
+	l := &auditLog{path: path, maxBytes: maxBytes}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *auditLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	l.file = file
+	l.size = info.Size()
+	l.opened = time.Now()
+	return nil
+}
+
+// rotate moves the current file aside and starts a new one. The current file is kept open until the
+// new one is, so that entries are still written to the moved file if it can't be.
+func (l *auditLog) rotate(now time.Time) error {
+	if err := os.Rename(l.path, l.path+"."+now.Format("20060102T150405.000")); err != nil {
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+
+	previous := l.file
+	if err := l.open(); err != nil {
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+	previous.Close()
+	return nil
+}
+
+// Write appends the given entry to the audit log. It is safe for concurrent use.
+func (l *auditLog) Write(entry auditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// A failed rotation is retried with the next entry, the entry is written to the current file
+	var rotateErr error
+	now := time.Now()
+	midnight := now.YearDay() != l.opened.YearDay() || now.Year() != l.opened.Year()
+	if midnight || (l.maxBytes > 0 && l.size+int64(len(line)) > l.maxBytes && l.size > 0) {
+		rotateErr = l.rotate(now)
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return errors.Join(rotateErr, err)
+}
+
+// Close closes the audit log file.
+func (l *auditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/lib/pq/oid"
+	"github.com/timescale/pg-logfire/internal/pgcatalog"
+)
+
+// catalogTablePattern matches tables read in a FROM or JOIN clause, with their schema if qualified.
+var catalogTablePattern = regexp.MustCompile(`(?i)\b(from|join)(\s+)(?:(\w+)\s*\.\s*)?(\w+)\b`)
+
+// tableClauseKeywords are keywords that may follow a table in a FROM clause, which therefore can't be
+// its alias.
+var tableClauseKeywords = map[string]bool{
+	"where": true, "join": true, "inner": true, "left": true, "right": true, "full": true,
+	"cross": true, "natural": true, "on": true, "using": true, "group": true, "order": true,
+	"limit": true, "offset": true, "union": true, "except": true, "intersect": true,
+	"having": true, "window": true, "fetch": true, "for": true,
+}
+
+// tableNameFilterPattern matches a comparison of the table_name column with a single table, such as
+// the ones schema introspection tools run with the table as a parameter.
+var tableNameFilterPattern = regexp.MustCompile(`(?i)\btable_name\s*=\s*('(?:[^']|'')*'|null\b)`)
+
+// listElementPattern matches the element type in the Arrow name of a list type, which is either the
+// name of the element type or the description of the element field.
+var listElementPattern = regexp.MustCompile(`^(?:.*?data_type: )?(?:nullable )?(\w+)`)
+
+// pgTypeNames maps PostgreSQL type OIDs to their names in the data_type and udt_name columns of
+// information_schema.columns.
+var pgTypeNames = map[oid.Oid][2]string{
+	oid.T_text:        {"text", "text"},
+	oid.T_bytea:       {"bytea", "bytea"},
+	oid.T_uuid:        {"uuid", "uuid"},
+	oid.T_bool:        {"boolean", "bool"},
+	oid.T_int2:        {"smallint", "int2"},
+	oid.T_int4:        {"integer", "int4"},
+	oid.T_int8:        {"bigint", "int8"},
+	oid.T_numeric:     {"numeric", "numeric"},
+	oid.T_float4:      {"real", "float4"},
+	oid.T_float8:      {"double precision", "float8"},
+	oid.T_date:        {"date", "date"},
+	oid.T_time:        {"time without time zone", "time"},
+	oid.T_timestamptz: {"timestamp with time zone", "timestamptz"},
+	oid.T_interval:    {"interval", "interval"},
+	oid.T_jsonb:       {"jsonb", "jsonb"},
+	oid.T__text:       {"ARRAY", "_text"},
+	oid.T__bool:       {"ARRAY", "_bool"},
+	oid.T__int2:       {"ARRAY", "_int2"},
+	oid.T__int4:       {"ARRAY", "_int4"},
+	oid.T__int8:       {"ARRAY", "_int8"},
+	oid.T__float4:     {"ARRAY", "_float4"},
+	oid.T__float8:     {"ARRAY", "_float8"},
+	oid.T__date:       {"ARRAY", "_date"},
+	oid.T__numeric:    {"ARRAY", "_numeric"},
+	oid.T__interval:   {"ARRAY", "_interval"},
+}
+
+// rewriteCatalogQuery returns the given query with the information_schema views and system catalogs
+// it reads replaced by a subquery listing their rows, as BI tools such as Metabase or Tableau and SQL
+// clients such as DBeaver or pgAdmin discover tables, columns and types this way. Logfire then
+// evaluates the query itself, including the columns it selects and its filters.
+func (s *PostgreServer) rewriteCatalogQuery(ctx context.Context, query string) (string, error) {
+	return replaceInCode(query, catalogTablePattern, func(match []int) (string, bool, error) {
+		var schema string
+		if match[6] >= 0 {
+			schema = strings.ToLower(query[match[6]:match[7]])
+		}
+		name := strings.ToLower(query[match[8]:match[9]])
+
+		var view func(ctx context.Context, query string) (wire.Columns, [][]any, error)
+		switch {
+		case schema == "information_schema" && name == "tables":
+			view = s.informationSchemaTables
+		case schema == "information_schema" && name == "columns":
+			view = s.informationSchemaColumns
+		case (schema == "pg_catalog" || schema == "") && name == "pg_type":
+			view = pgTypeView
+		case (schema == "pg_catalog" || schema == "") && name == "pg_namespace":
+			view = pgNamespaceView
+		default:
+			return "", false, nil
+		}
+
+		columns, rows, err := view(ctx, query)
+		if err != nil {
+			return "", false, err
+		}
+
+		replacement := query[match[2]:match[5]] + valuesSubquery(columns, rows)
+		if !hasTableAlias(query[match[1]:]) {
+			replacement += " AS " + name
+		}
+		return replacement, true, nil
+	})
+}
+
+// informationSchemaTables returns the columns and rows of information_schema.tables, listing the
+// tables of the Logfire project as tables of the database the client connected to.
+func (s *PostgreServer) informationSchemaTables(ctx context.Context, query string) (wire.Columns, [][]any, error) {
+	columns, rows, err := s.queryRows(ctx, "SHOW TABLES")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	database := wire.ClientParameters(ctx)[wire.ParamDatabase]
+	schemaIdx, nameIdx, typeIdx := slices.Index(columns, "table_schema"), slices.Index(columns, "table_name"), slices.Index(columns, "table_type")
+	if nameIdx < 0 {
+		return nil, nil, fmt.Errorf("unexpected result of SHOW TABLES, columns: %s", strings.Join(columns, ", "))
+	}
+
+	var tables [][]any
+	for _, row := range rows {
+		schema, typ := "public", "BASE TABLE"
+		if schemaIdx >= 0 && row[schemaIdx] != nil {
+			schema = fmt.Sprint(row[schemaIdx])
+		}
+		if typeIdx >= 0 && row[typeIdx] != nil {
+			typ = fmt.Sprint(row[typeIdx])
+		}
+		tables = append(tables, []any{database, schema, fmt.Sprint(row[nameIdx]), typ})
+	}
+
+	return catalogColumns("table_catalog", "table_schema", "table_name", "table_type"), tables, nil
+}
+
+// informationSchemaColumns returns the columns and rows of information_schema.columns, with the
+// columns Logfire lists for the table the given query filters on, or for every table if it doesn't.
+func (s *PostgreServer) informationSchemaColumns(ctx context.Context, query string) (wire.Columns, [][]any, error) {
+	var tables [][]any
+	if matches := tableNameFilterPattern.FindStringSubmatch(query); matches != nil {
+		// A comparison with NULL, as in the preflight query of a prepared statement, matches nothing
+		if !strings.EqualFold(matches[1], "null") {
+			name := strings.ReplaceAll(strings.Trim(matches[1], "'"), "''", "'")
+			tables = [][]any{{nil, nil, name, nil}}
+		}
+	} else {
+		var err error
+		if _, tables, err = s.informationSchemaTables(ctx, query); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	database := wire.ClientParameters(ctx)[wire.ParamDatabase]
+	var rows [][]any
+	for _, table := range tables {
+		// Logfire's own information_schema is not listed, like pg_catalog's isn't
+		if table[1] == "information_schema" {
+			continue
+		}
+
+		name := table[2].(string)
+		columns, columnRows, err := s.queryRows(ctx, "SHOW COLUMNS FROM "+quoteIdentifier(name))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		schemaIdx, columnIdx, typeIdx, nullableIdx := slices.Index(columns, "table_schema"), slices.Index(columns, "column_name"), slices.Index(columns, "data_type"), slices.Index(columns, "is_nullable")
+		if columnIdx < 0 || typeIdx < 0 {
+			return nil, nil, fmt.Errorf("unexpected result of SHOW COLUMNS, columns: %s", strings.Join(columns, ", "))
+		}
+
+		for i, row := range columnRows {
+			schema, nullable := "public", "YES"
+			if schemaIdx >= 0 && row[schemaIdx] != nil {
+				schema = fmt.Sprint(row[schemaIdx])
+			}
+			if nullableIdx >= 0 && row[nullableIdx] != nil {
+				nullable = fmt.Sprint(row[nullableIdx])
+			}
+
+			typeNames, ok := pgTypeNames[arrowTypeNameToPgOid(fmt.Sprint(row[typeIdx]))]
+			if !ok {
+				typeNames = pgTypeNames[oid.T_text]
+			}
+			rows = append(rows, []any{database, schema, name, fmt.Sprint(row[columnIdx]), i + 1, nil, nullable, typeNames[0], typeNames[1]})
+		}
+	}
+
+	columns := catalogColumns("table_catalog", "table_schema", "table_name", "column_name", "ordinal_position", "column_default", "is_nullable", "data_type", "udt_name")
+	columns[4].Oid = oid.T_int8
+	return columns, rows, nil
+}
+
+// pgTypeView returns the columns and rows of pg_catalog.pg_type, listing the types values are
+// returned as.
+func pgTypeView(ctx context.Context, query string) (wire.Columns, [][]any, error) {
+	var rows [][]any
+	for _, typ := range pgcatalog.Types {
+		rows = append(rows, []any{int(typ.OID), typ.Name, pgCatalogNamespace, pgBootstrapSuperuser, typ.Len, typ.ByVal, "b", string(typ.Category), true, ",", 0, int(typ.Elem), int(typ.Array), 0, -1, 0, false})
+	}
+
+	columns := catalogColumns("oid", "typname", "typnamespace", "typowner", "typlen", "typbyval", "typtype", "typcategory", "typisdefined", "typdelim", "typrelid", "typelem", "typarray", "typbasetype", "typtypmod", "typndims", "typnotnull")
+	for i, column := range columns {
+		switch column.Name {
+		case "oid", "typnamespace", "typowner", "typlen", "typrelid", "typelem", "typarray", "typbasetype", "typtypmod", "typndims":
+			columns[i].Oid = oid.T_int8
+		case "typbyval", "typisdefined", "typnotnull":
+			columns[i].Oid = oid.T_bool
+		}
+	}
+	return columns, rows, nil
+}
+
+// pgNamespaceView returns the columns and rows of pg_catalog.pg_namespace, listing the public schema
+// the tables of the Logfire project are in, so that schema browsers such as DBeaver or pgAdmin show it.
+func pgNamespaceView(ctx context.Context, query string) (wire.Columns, [][]any, error) {
+	rows := [][]any{{pgPublicNamespace, "public", 0, nil}}
+
+	columns := catalogColumns("oid", "nspname", "nspowner", "nspacl")
+	columns[0].Oid = oid.T_int8
+	columns[2].Oid = oid.T_int8
+	return columns, rows, nil
+}
+
+// arrowTypeNameToPgOid maps an Arrow type, in the form Logfire names it in SHOW COLUMNS, such as
+// Int64 or Timestamp(Microsecond, Some("UTC")), to the PostgreSQL type its values are returned as.
+// Unknown types are mapped to text.
+func arrowTypeNameToPgOid(name string) oid.Oid {
+	base, args, _ := strings.Cut(name, "(")
+	args = strings.TrimSuffix(args, ")")
+
+	switch base {
+	case "Utf8", "LargeUtf8", "Utf8View":
+		return oid.T_text
+	case "Binary", "LargeBinary", "BinaryView":
+		return oid.T_bytea
+	case "FixedSizeBinary":
+		// 16 byte values are UUIDs
+		if args == "16" {
+			return oid.T_uuid
+		}
+		return oid.T_bytea
+	case "Boolean":
+		return oid.T_bool
+	case "Int8", "Int16", "UInt8":
+		return oid.T_int2
+	case "Int32", "UInt16":
+		return oid.T_int4
+	case "Int64", "UInt32":
+		return oid.T_int8
+	case "UInt64", "Decimal128", "Decimal256":
+		return oid.T_numeric
+	case "Float16", "Float32":
+		return oid.T_float4
+	case "Float64":
+		return oid.T_float8
+	case "Date32", "Date64":
+		return oid.T_date
+	case "Time32", "Time64":
+		return oid.T_time
+	case "Timestamp":
+		return oid.T_timestamptz
+	case "Duration", "Interval":
+		return oid.T_interval
+	case "Struct", "Map":
+		return oid.T_jsonb
+	case "Dictionary":
+		_, value, _ := strings.Cut(args, ", ")
+		return arrowTypeNameToPgOid(value)
+	case "List", "LargeList", "FixedSizeList":
+		if matches := listElementPattern.FindStringSubmatch(args); matches != nil {
+			if arrayOid, ok := pgArrayOid(arrowTypeNameToPgOid(matches[1])); ok {
+				return arrayOid
+			}
+		}
+		// Elements without a PostgreSQL array type are returned as a JSON array instead
+		return oid.T_jsonb
+	default:
+		return oid.T_text
+	}
+}
+
+// queryRows runs the given query on Logfire and returns the names of its columns and all of its rows.
+// It is meant for small results, such as the metadata of the project.
+func (s *PostgreServer) queryRows(ctx context.Context, query string) ([]string, [][]any, error) {
+	result, err := s.openQuery(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer result.close()
+
+	var columns []string
+	for _, column := range result.columns {
+		columns = append(columns, column.Name)
+	}
+
+	var rows [][]any
+	for result.reader.Next() {
+		record := result.reader.Record()
+		for i := range int(record.NumRows()) {
+			row := make([]any, record.NumCols())
+			for j := range row {
+				val, err := arrowValueToInterface(record.Column(j), i, time.UTC)
+				if err != nil {
+					return nil, nil, fmt.Errorf("failed to convert column %d row %d: %w", j, i, err)
+				}
+				row[j] = val
+			}
+			rows = append(rows, row)
+		}
+	}
+	if err := result.reader.Err(); err != nil {
+		if result.ctx.Err() == context.DeadlineExceeded {
+			return nil, nil, errQueryTimeout
+		}
+		if errors.Is(err, errResponseTooLarge) {
+			return nil, nil, errResponseTooLarge
+		}
+		return nil, nil, fmt.Errorf("error reading arrow stream: %w", err)
+	}
+
+	return columns, rows, nil
+}
+
+// OIDs of the pg_catalog namespace and of the bootstrap superuser, which own the system catalogs, and
+// of the public namespace.
+const (
+	pgCatalogNamespace   = 11
+	pgBootstrapSuperuser = 10
+	pgPublicNamespace    = 2200
+)
+
+// catalogColumns returns text columns with the given names.
+func catalogColumns(names ...string) wire.Columns {
+	var columns wire.Columns
+	for _, name := range names {
+		columns = append(columns, wire.Column{Table: 0, Name: name, Oid: oid.T_text, Width: 256})
+	}
+	return columns
+}
+
+// valuesSubquery returns a parenthesised query returning the given rows, with the given text, bigint
+// or boolean columns.
+func valuesSubquery(columns wire.Columns, rows [][]any) string {
+	literal := func(column wire.Column, value any) string {
+		switch value := value.(type) {
+		case nil:
+			switch column.Oid {
+			case oid.T_int8:
+				return "CAST(NULL AS BIGINT)"
+			case oid.T_bool:
+				return "CAST(NULL AS BOOLEAN)"
+			default:
+				return "CAST(NULL AS TEXT)"
+			}
+		case int:
+			return strconv.Itoa(value)
+		case bool:
+			return strconv.FormatBool(value)
+		default:
+			return quoteLiteral(fmt.Sprint(value))
+		}
+	}
+
+	selects := make([]string, 0, len(rows))
+	for _, row := range rows {
+		var values []string
+		for i, column := range columns {
+			values = append(values, literal(column, row[i])+" AS "+column.Name)
+		}
+		selects = append(selects, "SELECT "+strings.Join(values, ", "))
+	}
+
+	// Without rows, a query returning nothing still has the types of the columns
+	if len(selects) == 0 {
+		var values []string
+		for _, column := range columns {
+			values = append(values, literal(column, nil)+" AS "+column.Name)
+		}
+		selects = append(selects, "SELECT "+strings.Join(values, ", ")+" WHERE false")
+	}
+
+	return "(" + strings.Join(selects, " UNION ALL ") + ")"
+}
+
+// hasTableAlias reports whether the rest of a query following a table in a FROM clause starts with
+// an alias for it.
+func hasTableAlias(rest string) bool {
+	rest = strings.TrimLeft(rest, " \t\n\r\f\v")
+	if strings.HasPrefix(rest, `"`) {
+		return true
+	}
+
+	end := 0
+	for end < len(rest) && isIdentifierChar(rest, end) {
+		end++
+	}
+	word := strings.ToLower(rest[:end])
+	return word != "" && !tableClauseKeywords[word]
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+
+	wire "github.com/jeroenrinzema/psql-wire"
+)
+
+// columnCacheSize is the maximum number of statements whose columns are remembered by a columnCache.
+const columnCacheSize = 1024
+
+// columnCache remembers the result columns of parameterized statements looked up by preflight queries,
+// so that clients preparing the same statement again, e.g. for every query with database/sql, don't
+// send another preflight query to Logfire. Statements are keyed by a SHA-256 hash of the read token
+// and statement text, and the least recently used one is evicted once the cache is full.
+type columnCache struct {
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	// lru holds *columnCacheEntry values, most recently used first.
+	lru *list.List
+}
+
+type columnCacheEntry struct {
+	key     [sha256.Size]byte
+	columns wire.Columns
+}
+
+func newColumnCache() *columnCache {
+	return &columnCache{
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func columnCacheKey(token, query string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(token + "\x00" + query))
+}
+
+// get returns the columns of the given statement, if known.
+func (c *columnCache) get(token, query string) (wire.Columns, bool) {
+	key := columnCacheKey(token, query)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*columnCacheEntry).columns, true
+}
+
+// add records the columns of the given statement.
+func (c *columnCache) add(token, query string, columns wire.Columns) {
+	key := columnCacheKey(token, query)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*columnCacheEntry).columns = columns
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&columnCacheEntry{key: key, columns: columns})
+	if c.lru.Len() > columnCacheSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*columnCacheEntry).key)
+	}
+}
+
+// remove forgets the columns of the given statement, e.g. after its result columns changed.
+func (c *columnCache) remove(token, query string) {
+	key := columnCacheKey(token, query)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+	}
+}
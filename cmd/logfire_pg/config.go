@@ -0,0 +1,135 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is the prefix of the environment variables that mirror the command line flags, e.g.
+// LOGFIRE_PG_BASE_URL for --base-url.
+const envPrefix = "LOGFIRE_PG_"
+
+// sdkTokenEnv is the environment variable the Logfire SDKs read their token from, used as the static
+// token with --token-from-env.
+const sdkTokenEnv = "LOGFIRE_TOKEN"
+
+// actionFlags are the flags that print something and exit instead of configuring the server. They are
+// only read from the command line, so that e.g. a LOGFIRE_PG_VERSION variable meant for something else
+// doesn't stop the server.
+var actionFlags = map[string]bool{
+	"help":           true,
+	"version":        true,
+	"config-example": true,
+}
+
+// exampleConfig is a documented sample configuration file, printed by --config-example.
+//
+//go:embed config.example.yaml
+var exampleConfig string
+
+// defaultConfigPath returns the config file looked up when --config is not given.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "logfire-pg", "config.yaml")
+}
+
+// envVarName returns the environment variable mirroring the flag with the given name.
+func envVarName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnv sets every flag that was not passed on the command line from its LOGFIRE_PG_* environment
+// variable, if present, except for the actionFlags. It must run before
+// applyConfigFile so that the environment takes precedence over the config file.
+func applyEnv(flags *flag.FlagSet) error {
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Changed || actionFlags[f.Name] {
+			return
+		}
+
+		value, ok := os.LookupEnv(envVarName(f.Name))
+		if !ok {
+			return
+		}
+
+		if setErr := flags.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value for %s: %w", envVarName(f.Name), setErr)
+		}
+	})
+	return err
+}
+
+// applyConfigFile reads the YAML config file at path and applies its values to the flags in the given
+// set. Keys mirror the flag names, except for --config and the actionFlags; flags that were already
+// set on the command line or through the environment are left alone so that they take precedence over
+// the file. When required is false, a missing file is ignored.
+func applyConfigFile(flags *flag.FlagSet, path string, required bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !required && errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var values map[string]any
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	for key, value := range values {
+		name := strings.ReplaceAll(key, "_", "-")
+		f := flags.Lookup(name)
+		if f == nil || name == "config" || actionFlags[name] {
+			return fmt.Errorf("invalid config file %s: unknown key %q", path, key)
+		}
+
+		if f.Changed {
+			continue
+		}
+
+		if err := setFlagFromConfig(flags, name, value); err != nil {
+			return fmt.Errorf("invalid config file %s: key %q: %w", path, key, err)
+		}
+	}
+
+	return nil
+}
+
+// setFlagFromConfig sets the named flag from a decoded YAML value. Lists set the flag once per item,
+// which appends for repeatable flags, and mappings once per entry as key:value, e.g. for
+// --project-map.
+func setFlagFromConfig(flags *flag.FlagSet, name string, value any) error {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []any:
+		for _, item := range v {
+			if err := setFlagFromConfig(flags, name, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]any:
+		for key, item := range v {
+			if err := flags.Set(name, fmt.Sprintf("%s:%v", key, item)); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return flags.Set(name, fmt.Sprint(v))
+	}
+}
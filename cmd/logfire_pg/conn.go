@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/jeroenrinzema/psql-wire/pkg/buffer"
+)
+
+// connTracker keeps track of the open client connections so that callbacks can be run once a
+// connection is closed. psql-wire only invokes the TerminateConn callback when the client sends a
+// Terminate message, which clients that simply drop the connection never do.
+type connTracker struct {
+	// conns maps the remote address of every open connection to its *trackedConn.
+	conns sync.Map
+	// localConns numbers the connections made over Unix domain sockets, which have no remote address.
+	localConns atomic.Uint64
+	// lastID is the ID of the last connection identified by identify.
+	lastID atomic.Uint64
+}
+
+type connIDCtxKey struct{}
+
+// identify wraps the given auth strategy to number the connections, starting at 1. The ID is added to
+// the context, which psql-wire keeps for the whole session, and is logged with every record logged
+// with the context.
+func (t *connTracker) identify(next wire.AuthStrategy) wire.AuthStrategy {
+	return func(ctx context.Context, writer *buffer.Writer, reader *buffer.Reader) (context.Context, error) {
+		ctx = context.WithValue(ctx, connIDCtxKey{}, t.lastID.Add(1))
+		return next(ctx, writer, reader)
+	}
+}
+
+// listen returns a listener whose accepted connections are tracked.
+func (t *connTracker) listen(listener net.Listener) net.Listener {
+	return trackedListener{Listener: listener, tracker: t}
+}
+
+// conn returns the connection of the given session context.
+func (t *connTracker) conn(ctx context.Context) (*trackedConn, bool) {
+	conn, ok := t.conns.Load(wire.RemoteAddress(ctx).String())
+	if !ok {
+		return nil, false
+	}
+	return conn.(*trackedConn), true
+}
+
+// onClose registers fn to be called once the connection of the given session context is closed. It
+// returns false if the connection is not tracked.
+func (t *connTracker) onClose(ctx context.Context, fn func()) bool {
+	conn, ok := t.conn(ctx)
+	if !ok {
+		return false
+	}
+
+	conn.onClose(fn)
+	return true
+}
+
+// watch watches the connection of the given session context until the returned function is called,
+// see trackedConn.watch.
+func (t *connTracker) watch(ctx context.Context) (stop func()) {
+	conn, ok := t.conn(ctx)
+	if !ok {
+		return func() {}
+	}
+	return conn.watch()
+}
+
+// closeAll closes all open connections, which cancels their sessions.
+func (t *connTracker) closeAll() {
+	t.conns.Range(func(_, conn any) bool {
+		conn.(*trackedConn).Close()
+		return true
+	})
+}
+
+type trackedListener struct {
+	net.Listener
+	tracker *connTracker
+}
+
+func (l trackedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	remoteAddr := conn.RemoteAddr()
+	if remoteAddr.Network() == "unix" {
+		remoteAddr = &net.UnixAddr{Name: fmt.Sprintf("[local]:%d", l.tracker.localConns.Add(1)), Net: "unix"}
+	}
+
+	activeConnections.Inc()
+	tracked := &trackedConn{Conn: conn, tracker: l.tracker, remoteAddr: remoteAddr}
+	l.tracker.conns.Store(remoteAddr.String(), tracked)
+	return tracked, nil
+}
+
+// trackedConn runs the registered callbacks once when it is closed.
+type trackedConn struct {
+	net.Conn
+	tracker *connTracker
+	// remoteAddr identifies the connection, it is unique for Unix domain socket connections as well.
+	remoteAddr net.Addr
+
+	mu      sync.Mutex
+	closed  bool
+	closers []func()
+
+	// pending holds the data received by watch that has yet to be read, and readErr the error that
+	// ended it, returned by Read once pending is drained.
+	pending []byte
+	readErr error
+}
+
+// onClose registers fn to be called once the connection is closed, or calls it right away if it
+// already is.
+func (c *trackedConn) onClose(fn func()) {
+	c.mu.Lock()
+	if !c.closed {
+		c.closers = append(c.closers, fn)
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+	fn()
+}
+
+func (c *trackedConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *trackedConn) Close() error {
+	c.mu.Lock()
+	closers := c.closers
+	alreadyClosed := c.closed
+	c.closed = true
+	c.closers = nil
+	c.mu.Unlock()
+
+	if !alreadyClosed {
+		c.tracker.conns.Delete(c.RemoteAddr().String())
+		activeConnections.Dec()
+		for _, fn := range closers {
+			fn()
+		}
+	}
+
+	return c.Conn.Close()
+}
+
+// maxWatchedBytes is the maximum number of bytes buffered by trackedConn.watch, after which it stops
+// reading from the connection.
+const maxWatchedBytes = 1 << 20
+
+// watch reads from the connection in the background until the returned function is called, and
+// closes it once the client has disconnected. psql-wire doesn't read from the connection while it
+// handles a message, so a client dropping the connection during a long query would otherwise go
+// unnoticed until the query finished. The data received meanwhile, e.g. the next messages of a
+// client pipelining its queries, is returned by Read later on. The connection must not be read
+// otherwise until watching stopped.
+func (c *trackedConn) watch() (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		buf := make([]byte, 4096)
+		for c.readErr == nil && len(c.pending) < maxWatchedBytes {
+			n, err := c.Conn.Read(buf)
+			c.pending = append(c.pending, buf[:n]...)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return
+			}
+			if err != nil {
+				c.readErr = err
+				c.Close()
+			}
+		}
+	}()
+
+	return func() {
+		// Reading is interrupted by a deadline in the past
+		c.Conn.SetReadDeadline(time.Now())
+		<-done
+		c.Conn.SetReadDeadline(time.Time{})
+	}
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/v18/arrow/ipc"
+	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/jeroenrinzema/psql-wire/codes"
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+	"github.com/lib/pq/oid"
+)
+
+// explainPattern matches EXPLAIN statements, either with a parenthesised option list or with the
+// legacy ANALYZE and VERBOSE keywords, capturing the options and the explained statement.
+var explainPattern = regexp.MustCompile(`(?is)^\s*explain\s+(?:\(([^)]*)\)|((?:(?:analy[sz]e|verbose)\s+)*))\s*(.*?)[\s;]*$`)
+
+// explainNode is the name of the single plan node reported for queries run on Logfire.
+const explainNode = "Logfire Remote Scan"
+
+// explainOptions holds the options of an EXPLAIN statement that affect its output.
+type explainOptions struct {
+	analyze bool
+	verbose bool
+	format  string
+}
+
+// explainPlan is the plan of a query run on Logfire in the JSON format of EXPLAIN.
+type explainPlan struct {
+	Plan struct {
+		NodeType        string   `json:"Node Type"`
+		StartupCost     float64  `json:"Startup Cost"`
+		TotalCost       float64  `json:"Total Cost"`
+		PlanRows        int      `json:"Plan Rows"`
+		PlanWidth       int      `json:"Plan Width"`
+		ActualTotalTime *float64 `json:"Actual Total Time,omitempty"`
+		ActualRows      *int     `json:"Actual Rows,omitempty"`
+		ActualLoops     *int     `json:"Actual Loops,omitempty"`
+		Output          []string `json:"Output,omitempty"`
+	} `json:"Plan"`
+	ExecutionTime *float64 `json:"Execution Time,omitempty"`
+}
+
+// parseExplain returns the options and the explained statement when the given query is an EXPLAIN
+// statement.
+func parseExplain(query string) (opts explainOptions, statement string, ok bool) {
+	matches := explainPattern.FindStringSubmatch(query)
+	if matches == nil || matches[3] == "" {
+		return explainOptions{}, "", false
+	}
+
+	opts.format = "text"
+	for _, keyword := range strings.Fields(strings.ToLower(matches[2])) {
+		switch keyword {
+		case "analyze", "analyse":
+			opts.analyze = true
+		case "verbose":
+			opts.verbose = true
+		}
+	}
+
+	for _, option := range strings.Split(matches[1], ",") {
+		fields := strings.Fields(strings.ToLower(option))
+		if len(fields) == 0 {
+			continue
+		}
+
+		value := "true"
+		if len(fields) > 1 {
+			value = strings.Trim(fields[1], `'`)
+		}
+
+		// Other options, such as COSTS or BUFFERS, have no effect on the plan of a remote query
+		enabled := value == "true" || value == "on" || value == "1"
+		switch fields[0] {
+		case "analyze", "analyse":
+			opts.analyze = enabled
+		case "verbose":
+			opts.verbose = enabled
+		case "format":
+			opts.format = value
+		}
+	}
+
+	return opts, matches[3], true
+}
+
+// explainResult runs the explained statement on Logfire and returns a plan describing it. The Logfire
+// API has no notion of query plans, so the plan consists of a single remote scan node. Without ANALYZE
+// the rows are discarded once Logfire accepted the query, with ANALYZE they are read to time the query.
+func (s *PostgreServer) explainResult(ctx context.Context, opts explainOptions, statement string) (_ wire.PreparedStatements, rows int, err error) {
+	if opts.format != "text" && opts.format != "json" {
+		err := fmt.Errorf("EXPLAIN format %q is not supported, expected one of: text, json", opts.format)
+		return nil, 0, psqlerr.WithSeverity(psqlerr.WithCode(err, codes.FeatureNotSupported), psqlerr.LevelError)
+	}
+
+	if s.queryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.queryTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	sql, err := s.rewriteCatalogQuery(ctx, statement)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	readToken := ctx.Value(readTokenCtxKey{}).(string)
+	respBody, err := s.executeQueryWithRetry(ctx, sql, readToken)
+	if err != nil {
+		s.logger.WarnContext(ctx, "query execution error", "query", statement, "err", err)
+		return nil, 0, clientQueryError(ctx, err)
+	}
+	defer respBody.Close()
+
+	reader, err := ipc.NewReader(respBody)
+	if err != nil {
+		s.logger.WarnContext(ctx, "failed to create arrow reader", "query", statement, "err", err)
+		if errors.Is(err, errResponseTooLarge) {
+			return nil, 0, errResponseTooLarge
+		}
+		return nil, 0, psqlerr.WithSeverity(psqlerr.WithCode(err, codes.DataException), psqlerr.LevelFatal)
+	}
+	defer reader.Release()
+
+	var plan explainPlan
+	plan.Plan.NodeType = explainNode
+	if opts.verbose {
+		for _, field := range reader.Schema().Fields() {
+			plan.Plan.Output = append(plan.Plan.Output, field.Name)
+		}
+	}
+
+	if opts.analyze {
+		actualRows := 0
+		for reader.Next() {
+			actualRows += int(reader.Record().NumRows())
+		}
+		if err := reader.Err(); err != nil {
+			s.logger.WarnContext(ctx, "query execution error", "query", statement, "err", err)
+			return nil, 0, clientQueryError(ctx, err)
+		}
+
+		// Durations are reported in milliseconds with microsecond precision, like PostgreSQL does
+		elapsed := float64(time.Since(start).Microseconds()) / 1000
+		loops := 1
+		plan.Plan.ActualTotalTime = &elapsed
+		plan.Plan.ActualRows = &actualRows
+		plan.Plan.ActualLoops = &loops
+		plan.ExecutionTime = &elapsed
+	}
+
+	if opts.format == "json" {
+		value, err := json.MarshalIndent([]explainPlan{plan}, "", "  ")
+		if err != nil {
+			return nil, 0, err
+		}
+		return explainStatement(oid.T_json, []any{string(value)}), 1, nil
+	}
+
+	line := fmt.Sprintf("%s (cost=0.00..0.00 rows=0 width=0)", explainNode)
+	if opts.analyze {
+		line += fmt.Sprintf(" (actual time=0.000..%.3f rows=%d loops=1)", *plan.Plan.ActualTotalTime, *plan.Plan.ActualRows)
+	}
+	lines := []any{line}
+	if opts.verbose {
+		lines = append(lines, "  Output: "+strings.Join(plan.Plan.Output, ", "))
+	}
+	if opts.analyze {
+		lines = append(lines, fmt.Sprintf("Execution Time: %.3f ms", *plan.ExecutionTime))
+	}
+
+	return explainStatement(oid.T_text, lines), len(lines), nil
+}
+
+// explainStatement returns a statement writing the given lines of an EXPLAIN output of the given type.
+func explainStatement(typ oid.Oid, lines []any) wire.PreparedStatements {
+	column := wire.Column{Table: 0, Name: "QUERY PLAN", Oid: typ, Width: 256}
+	handle := func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+		for _, line := range lines {
+			if err := writer.Row([]any{line}); err != nil {
+				return err
+			}
+		}
+		return writer.Complete("EXPLAIN")
+	}
+
+	return wire.Prepared(wire.NewStatement(handle, wire.WithColumns(wire.Columns{column})))
+}
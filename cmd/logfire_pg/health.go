@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// readinessTimeout bounds the request made to the Logfire API by a readiness probe.
+const readinessTimeout = 5 * time.Second
+
+// serveHealth serves the liveness probe on /healthz and the readiness probe on /readyz at the given
+// address.
+func (s *PostgreServer) serveHealth(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+	return http.ListenAndServe(addr, mux)
+}
+
+// handleHealthz reports whether the server is accepting connections, i.e. is not shutting down.
+func (s *PostgreServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if s.shuttingDown.Load() {
+		writeHealth(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	}
+	writeHealth(w, http.StatusOK, "")
+}
+
+// handleReadyz additionally reports whether the Logfire API is reachable.
+func (s *PostgreServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if s.shuttingDown.Load() {
+		writeHealth(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	if err := s.checkLogfire(ctx); err != nil {
+		s.logger.WarnContext(ctx, "readiness check failed", "err", err)
+		writeHealth(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeHealth(w, http.StatusOK, "")
+}
+
+// checkLogfire runs the query used to validate tokens against the Logfire API, with the static token
+// or a mapped project token if configured. Without a token, a rejected request still shows that the
+// API is reachable. A dry run never makes requests to the API.
+func (s *PostgreServer) checkLogfire(ctx context.Context) error {
+	if s.dryRun {
+		return nil
+	}
+
+	token := s.staticToken.Load().(string)
+	if token == "" {
+		for _, projectToken := range s.projectMap {
+			token = projectToken
+			break
+		}
+	}
+
+	respBody, err := executeQuery(ctx, s.httpClient, s.baseURL, s.userAgent, "SELECT 1", token)
+	if err != nil {
+		if token == "" && isUnauthorized(err) {
+			return nil
+		}
+		return err
+	}
+	respBody.Close()
+	return nil
+}
+
+// writeHealth writes the response of a health probe, with the given error message unless it is empty.
+func writeHealth(w http.ResponseWriter, status int, errMsg string) {
+	body := map[string]string{"status": "ok"}
+	if status != http.StatusOK {
+		body["status"] = "unavailable"
+	}
+	if errMsg != "" {
+		body["error"] = errMsg
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/jeroenrinzema/psql-wire/codes"
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+	"github.com/lib/pq/oid"
+)
+
+// defaultPGVersion is the PostgreSQL server version advertised to clients unless --version-string is
+// set.
+const defaultPGVersion = "17.0"
+
+// pgVersionPattern matches PostgreSQL version strings, e.g. 17.0, 14.5 or 9.6.24.
+var pgVersionPattern = regexp.MustCompile(`^(\d+)\.(\d+)(?:\.(\d+))?$`)
+
+// pgVersionNum returns the server_version_num of the given PostgreSQL version, e.g. 140005 for 14.5
+// or 90624 for 9.6.24, which has a patch level before PostgreSQL 10.
+func pgVersionNum(version string) (string, error) {
+	matches := pgVersionPattern.FindStringSubmatch(version)
+	if matches == nil {
+		return "", fmt.Errorf("invalid PostgreSQL version %q, expected e.g. 17.0 or 14.5", version)
+	}
+
+	major, _ := strconv.Atoi(matches[1])
+	minor, _ := strconv.Atoi(matches[2])
+	patch, _ := strconv.Atoi(matches[3])
+	if major >= 10 {
+		return strconv.Itoa(major*10000 + minor), nil
+	}
+	return strconv.Itoa(major*10000 + minor*100 + patch), nil
+}
+
+// serverParameters holds the values reported by SHOW for well-known PostgreSQL run-time parameters.
+// Clients such as SQLAlchemy query several of these right after connecting.
+var serverParameters = map[string]string{
+	"server_version":                defaultPGVersion,
+	"server_version_num":            "170000",
+	"server_encoding":               "UTF8",
+	"client_encoding":               "UTF8",
+	"standard_conforming_strings":   "on",
+	"integer_datetimes":             "on",
+	"datestyle":                     "ISO, MDY",
+	"intervalstyle":                 "postgres",
+	"timezone":                      "UTC",
+	"search_path":                   `"$user", public`,
+	"max_identifier_length":         "63",
+	"is_superuser":                  "off",
+	"default_transaction_read_only": "on",
+	"transaction_isolation":         "read committed",
+	"application_name":              "",
+}
+
+// showPattern matches SHOW statements for a single run-time parameter.
+var showPattern = regexp.MustCompile(`^show ([a-z_]+)$`)
+
+// setPattern matches SET statements assigning a value to a run-time parameter. It is matched
+// against the original query to preserve the case of the value.
+var setPattern = regexp.MustCompile(`(?is)^\s*set\s+(?:session\s+|local\s+)?(\w+)\s*(?:to|=)\s*(.*?)[\s;]*$`)
+
+// timeZonePattern matches SET TIME ZONE statements. Like setPattern, it is matched against the
+// original query to preserve the case of the time zone name.
+var timeZonePattern = regexp.MustCompile(`(?is)^\s*set\s+(?:session\s+|local\s+)?time\s+zone\s+(.*?)[\s;]*$`)
+
+// transactionPattern matches transaction control statements. The Logfire API is stateless, so these
+// are acknowledged without having any effect.
+var transactionPattern = regexp.MustCompile(`^(begin|start transaction|commit|end|abort|rollback|savepoint|release)\b`)
+
+// transactionTags maps transaction control statements to the command tags PostgreSQL responds with.
+var transactionTags = map[string]string{
+	"begin":             "BEGIN",
+	"start transaction": "START TRANSACTION",
+	"commit":            "COMMIT",
+	"end":               "COMMIT",
+	"abort":             "ROLLBACK",
+	"rollback":          "ROLLBACK",
+	"savepoint":         "SAVEPOINT",
+	"release":           "RELEASE",
+}
+
+// notificationPattern matches LISTEN, UNLISTEN and NOTIFY statements. Logfire has no asynchronous
+// notifications, so these are acknowledged without having any effect.
+var notificationPattern = regexp.MustCompile(`^(listen|unlisten|notify)\b`)
+
+// resetPattern matches RESET statements, restoring one or all run-time parameters to their defaults.
+var resetPattern = regexp.MustCompile(`^reset (all|[a-z_.]+)$`)
+
+// discardPattern matches DISCARD statements, which connection poolers such as PgBouncer issue to
+// reset the session before handing the connection to another client.
+var discardPattern = regexp.MustCompile(`^discard (all|plans|sequences|temp|temporary)$`)
+
+// deallocatePattern matches DEALLOCATE statements for one or all prepared statements.
+var deallocatePattern = regexp.MustCompile(`^deallocate (?:prepare )?(\S+)$`)
+
+// sessionFunctionPattern matches queries selecting a single session information function, such as
+// the connection checks run by ORMs, with an optional column alias. It is matched against the
+// original query to preserve the case of quoted aliases.
+var sessionFunctionPattern = regexp.MustCompile(`(?i)^\s*select\s+(?:pg_catalog\.)?(current_database\(\)|current_user|session_user|pg_backend_pid\(\))(?:\s+as\s+("[^"]+"|\w+))?[\s;]*$`)
+
+// tableIsVisiblePattern matches queries selecting a single call to pg_table_is_visible, which some
+// clients run to check whether a table is on the search path, capturing its argument. It is matched
+// against the code of the query, and the argument may still end in another expression, which
+// tableIsVisibleCall rules out.
+var tableIsVisiblePattern = regexp.MustCompile(`(?is)^\s*select\s+(?:pg_catalog\s*\.\s*)?pg_table_is_visible\s*\((.*)\)[\s;]*$`)
+
+// cancelBackendPattern matches queries cancelling the query of another backend by its process ID.
+var cancelBackendPattern = regexp.MustCompile(`^select (?:pg_catalog\.)?pg_cancel_backend\s*\(\s*\d+\s*\)$`)
+
+// forwardedShowStatements are SHOW statements implemented by the Logfire query engine itself.
+var forwardedShowStatements = map[string]bool{
+	"tables":    true,
+	"columns":   true,
+	"functions": true,
+	"all":       true,
+}
+
+// normalizeQuery lower-cases the given query, collapses whitespace and strips trailing semicolons so
+// that simple statements can be matched regardless of formatting.
+func normalizeQuery(query string) string {
+	normalized := strings.ToLower(strings.Join(strings.Fields(query), " "))
+	return strings.TrimSpace(strings.TrimRight(normalized, "; "))
+}
+
+// interceptQuery answers queries that can be handled locally without a round-trip to the Logfire API,
+// such as the version checks many clients issue right after connecting. ok is false when the query
+// has to be forwarded to Logfire.
+func (s *PostgreServer) interceptQuery(ctx context.Context, query string) (stmts wire.PreparedStatements, ok bool) {
+	state := getSessionState(ctx)
+	normalized := normalizeQuery(query)
+
+	switch normalized {
+	case "select version()", "select pg_catalog.version()":
+		return staticResult("SELECT 1", []string{"version"}, [][]any{{fmt.Sprintf("PostgreSQL %s (logfire-pg %s)", s.pgVersion, version)}}), true
+	case "show transaction isolation level":
+		return showResult(state, "transaction_isolation"), true
+	case "show time zone":
+		return showResult(state, "timezone"), true
+	case "select current_database(), current_user, inet_server_addr(), inet_server_port()":
+		// Sent by \conninfo
+		return s.connInfoResult(ctx), true
+	}
+
+	if matches := sessionFunctionPattern.FindStringSubmatch(query); matches != nil {
+		return sessionFunctionResult(ctx, strings.ToLower(matches[1]), identifierName(matches[2])), true
+	}
+
+	if tableIsVisibleCall(query) {
+		s.logger.InfoContext(ctx, "answering pg_table_is_visible locally", "query", query)
+		// All tables of a Logfire project are in the default namespace
+		return boolResult("pg_table_is_visible", true), true
+	}
+
+	if cancelBackendPattern.MatchString(normalized) {
+		// There are no backend processes, pg_backend_pid only returns a hash of the client address
+		s.logger.InfoContext(ctx, "query cancellation by PID is not supported, close the client connection to cancel", "query", query)
+		if err := sendNotice(ctx, "Query cancellation by PID is not supported in logfire-pg; close the client connection to cancel."); err != nil {
+			s.logger.WarnContext(ctx, "failed to send notice", "err", err)
+		}
+		return boolResult("pg_cancel_backend", false), true
+	}
+
+	if matches := showPattern.FindStringSubmatch(normalized); matches != nil && !forwardedShowStatements[matches[1]] {
+		return showResult(state, matches[1]), true
+	}
+
+	if matches := transactionPattern.FindStringSubmatch(normalized); matches != nil {
+		s.logger.InfoContext(ctx, "ignoring transaction statement", "query", normalized)
+		return commandResult(transactionTags[matches[1]]), true
+	}
+
+	if matches := notificationPattern.FindStringSubmatch(normalized); matches != nil {
+		s.logger.InfoContext(ctx, "asynchronous notifications are not supported by logfire-pg", "query", normalized)
+		if err := sendNotice(ctx, "Asynchronous notifications are not supported by logfire-pg"); err != nil {
+			s.logger.WarnContext(ctx, "failed to send notice", "err", err)
+		}
+		return commandResult(strings.ToUpper(matches[1])), true
+	}
+
+	if matches := resetPattern.FindStringSubmatch(normalized); matches != nil {
+		if matches[1] == "all" {
+			clear(state.parameters)
+		} else {
+			delete(state.parameters, matches[1])
+		}
+		s.logger.InfoContext(ctx, "session parameter reset", "name", matches[1])
+		return commandResult("RESET"), true
+	}
+
+	if matches := discardPattern.FindStringSubmatch(normalized); matches != nil {
+		// Only DISCARD ALL resets run-time parameters, there are no plans, sequences or temporary tables
+		if matches[1] == "all" {
+			clear(state.parameters)
+		}
+		return commandResult("DISCARD " + strings.ToUpper(strings.Replace(matches[1], "temporary", "temp", 1))), true
+	}
+
+	if matches := deallocatePattern.FindStringSubmatch(normalized); matches != nil {
+		// Prepared statements are kept by the protocol layer and released along with the connection
+		if matches[1] == "all" {
+			return commandResult("DEALLOCATE ALL"), true
+		}
+		return commandResult("DEALLOCATE"), true
+	}
+
+	if matches := timeZonePattern.FindStringSubmatch(query); matches != nil {
+		return s.setTimeZone(ctx, state, strings.Trim(matches[1], `'"`)), true
+	}
+
+	if matches := setPattern.FindStringSubmatch(query); matches != nil {
+		name := strings.ToLower(matches[1])
+		value := strings.Trim(matches[2], `'"`)
+		if name == "timezone" {
+			return s.setTimeZone(ctx, state, value), true
+		}
+		state.parameters[name] = value
+		s.logger.InfoContext(ctx, "session parameter set", "name", name, "value", value)
+		return commandResult("SET"), true
+	}
+
+	return nil, false
+}
+
+// tableIsVisibleCall reports whether the given query only selects a call to pg_table_is_visible. Other
+// queries calling it, such as catalog queries filtering on it, are forwarded to Logfire.
+func tableIsVisibleCall(query string) bool {
+	matches := tableIsVisiblePattern.FindStringSubmatch(codeOnly(query))
+	if matches == nil {
+		return false
+	}
+
+	// The parenthesis closing the call must be the last one, as in "pg_table_is_visible(c.oid)" but
+	// not "pg_table_is_visible(c.oid) FROM pg_class c WHERE f(c.oid)"
+	depth := 0
+	for _, c := range matches[1] {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth < 0 {
+				return false
+			}
+		}
+	}
+	return depth == 0
+}
+
+// setTimeZone changes the time zone of the session, failing the statement if it is unknown. LOCAL
+// and DEFAULT restore the server's time zone.
+func (s *PostgreServer) setTimeZone(ctx context.Context, state *sessionState, value string) wire.PreparedStatements {
+	if strings.EqualFold(value, "local") || strings.EqualFold(value, "default") {
+		delete(state.parameters, "timezone")
+		return commandResult("SET")
+	}
+
+	if _, err := loadTimeZone(value); err != nil {
+		return errorResult(psqlerr.WithSeverity(psqlerr.WithCode(err, codes.InvalidParameterValue), psqlerr.LevelError))
+	}
+
+	state.parameters["timezone"] = value
+	s.logger.InfoContext(ctx, "session time zone set", "timezone", value)
+	return commandResult("SET")
+}
+
+// connInfoResult returns the database and user of the session, and the address and port the client
+// connected to.
+func (s *PostgreServer) connInfoResult(ctx context.Context) wire.PreparedStatements {
+	params := wire.ClientParameters(ctx)
+
+	var addr, port any
+	if conn, ok := s.conns.conn(ctx); ok {
+		if host, p, err := net.SplitHostPort(conn.LocalAddr().String()); err == nil {
+			addr, port = host, p
+		}
+	}
+
+	columns := []string{"current_database", "current_user", "inet_server_addr", "inet_server_port"}
+	return staticResult("SELECT 1", columns, [][]any{{params[wire.ParamDatabase], params[wire.ParamUsername], addr, port}})
+}
+
+// identifierName returns the name of the given SQL identifier, folding unquoted identifiers to lower
+// case like PostgreSQL does.
+func identifierName(identifier string) string {
+	if unquoted, ok := strings.CutPrefix(identifier, `"`); ok {
+		return strings.TrimSuffix(unquoted, `"`)
+	}
+	return strings.ToLower(identifier)
+}
+
+// sessionFunctionResult returns the result of the given session information function, in a column
+// named alias if set.
+func sessionFunctionResult(ctx context.Context, function string, alias string) wire.PreparedStatements {
+	name := strings.TrimSuffix(function, "()")
+	if alias != "" {
+		name = alias
+	}
+
+	params := wire.ClientParameters(ctx)
+	var typ oid.Oid = oid.T_text
+	var value any
+	switch function {
+	case "current_database()":
+		value = params[wire.ParamDatabase]
+	case "current_user", "session_user":
+		value = params[wire.ParamUsername]
+	case "pg_backend_pid()":
+		// There is no backend process, a hash of the client address is stable for the connection
+		hash := fnv.New32a()
+		hash.Write([]byte(wire.RemoteAddress(ctx).String()))
+		typ, value = oid.T_int4, int32(hash.Sum32()&math.MaxInt32)
+	}
+
+	column := wire.Column{Table: 0, Name: name, Oid: typ, Width: 256}
+	handle := func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+		if err := writer.Row([]any{value}); err != nil {
+			return err
+		}
+		return writer.Complete("SELECT 1")
+	}
+
+	return wire.Prepared(wire.NewStatement(handle, wire.WithColumns(wire.Columns{column})))
+}
+
+// boolResult returns the result of a function returning the given boolean value.
+func boolResult(function string, value bool) wire.PreparedStatements {
+	column := wire.Column{Table: 0, Name: function, Oid: oid.T_bool, Width: 256}
+	handle := func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+		if err := writer.Row([]any{value}); err != nil {
+			return err
+		}
+		return writer.Complete("SELECT 1")
+	}
+
+	return wire.Prepared(wire.NewStatement(handle, wire.WithColumns(wire.Columns{column})))
+}
+
+// showResult returns the result of SHOW for the given run-time parameter. Unknown parameters produce
+// an empty result rather than an error.
+func showResult(state *sessionState, name string) wire.PreparedStatements {
+	value, ok := state.parameter(name)
+	if !ok {
+		return staticResult("SHOW", []string{name}, nil)
+	}
+
+	return staticResult("SHOW", []string{name}, [][]any{{value}})
+}
+
+// commandResult returns a statement that produces no rows and completes with the given command tag.
+func commandResult(tag string) wire.PreparedStatements {
+	handle := func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+		return writer.Complete(tag)
+	}
+
+	return wire.Prepared(wire.NewStatement(handle))
+}
+
+// errorResult returns a statement failing with the given error, for statements answered locally that
+// are invalid.
+func errorResult(err error) wire.PreparedStatements {
+	handle := func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+		return err
+	}
+
+	return wire.Prepared(wire.NewStatement(handle))
+}
+
+// staticResult returns a statement writing the given rows for a set of text columns, completed with
+// the given command tag.
+func staticResult(tag string, columns []string, rows [][]any) wire.PreparedStatements {
+	var cols wire.Columns
+	for _, name := range columns {
+		cols = append(cols, wire.Column{
+			Table: 0,
+			Name:  name,
+			Oid:   oid.T_text,
+			Width: 256,
+		})
+	}
+
+	handle := func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+		for _, row := range rows {
+			if err := writer.Row(row); err != nil {
+				return err
+			}
+		}
+		return writer.Complete(tag)
+	}
+
+	return wire.Prepared(wire.NewStatement(handle, wire.WithColumns(cols)))
+}
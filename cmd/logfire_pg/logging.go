@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// newLogger returns a logger writing records at or above the given level to w in the given format,
+// either text or json.
+func newLogger(w io.Writer, format string, level slog.Leveler) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "text":
+		return slog.New(connHandler{slog.NewTextHandler(w, opts)}), nil
+	case "json":
+		return slog.New(connHandler{slog.NewJSONHandler(w, opts)}), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected one of: text, json", format)
+	}
+}
+
+// connHandler adds the ID of the client connection a record is logged for to records logged with the
+// context of a connection, so that the interleaved logs of concurrent sessions can be told apart.
+type connHandler struct {
+	slog.Handler
+}
+
+func (h connHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id, ok := ctx.Value(connIDCtxKey{}).(uint64); ok {
+		record.AddAttrs(slog.Uint64("conn_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h connHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return connHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h connHandler) WithGroup(name string) slog.Handler {
+	return connHandler{h.Handler.WithGroup(name)}
+}
+
+// fatal logs the given message at error level and exits.
+func fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
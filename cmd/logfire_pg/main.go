@@ -1,15 +1,31 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math/big"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/apache/arrow/go/v18/arrow"
 	"github.com/apache/arrow/go/v18/arrow/array"
@@ -17,32 +33,230 @@ import (
 	wire "github.com/jeroenrinzema/psql-wire"
 	"github.com/jeroenrinzema/psql-wire/codes"
 	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+	"github.com/jeroenrinzema/psql-wire/pkg/buffer"
+	"github.com/jeroenrinzema/psql-wire/pkg/types"
 	"github.com/lib/pq/oid"
 	flag "github.com/spf13/pflag"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var version = "dev"
 
-var baseURL = "https://logfire-us.pydantic.dev"
-var queryUrl = baseURL + "/v1/query"
+// defaultUserAgent returns the User-Agent header sent to the Logfire API unless --user-agent is set,
+// which tells logfire-pg traffic apart from other clients of the API.
+func defaultUserAgent() string {
+	return "logfire-pg/" + version
+}
+
+// regionBaseURLs maps the supported Logfire regions to their API base URLs.
+var regionBaseURLs = map[string]string{
+	"us": "https://logfire-us.pydantic.dev",
+	"eu": "https://logfire-eu.pydantic.dev",
+}
 
 type PostgreServer struct {
-	server *wire.Server
-	logger *log.Logger
+	server  *wire.Server
+	logger  *slog.Logger
+	baseURL string
+	// staticToken holds the static token as a string, replaced when the token file is reloaded.
+	staticToken atomic.Value
+	projectMap  map[string]string
+	// projectName labels this instance in its log output and is reported to clients as application_name.
+	projectName string
+	// userAgent is sent to the Logfire API with every request.
+	userAgent string
+	// pgVersion is the PostgreSQL server version advertised to clients, pgVersionNum its
+	// server_version_num.
+	pgVersion          string
+	pgVersionNum       string
+	tokenCache         *tokenCache
+	retryPolicy        retryPolicy
+	queryTimeout       time.Duration
+	maxRows            int
+	arrowBufferSize    int
+	maxResponseBytes   int64
+	maxQuerySize       int
+	slowQueryThreshold time.Duration
+	auditLog           *auditLog
+	httpClient         *http.Client
+	conns              connTracker
+	// connSlots holds a token for every connected client when the number of connections is limited.
+	connSlots chan struct{}
+	// shuttingDown is set once Shutdown is called, failing the health checks.
+	shuttingDown atomic.Bool
+	// dryRun answers queries with empty results instead of forwarding them to Logfire.
+	dryRun bool
+	// skipAuthValidation accepts the passwords of clients as tokens without validating them.
+	skipAuthValidation bool
+	// columnCache remembers the result columns of parameterized statements.
+	columnCache *columnCache
+}
+
+// serverConfig holds the tunables used to construct a PostgreServer.
+type serverConfig struct {
+	// BaseURL is the base URL of the Logfire API, e.g. https://logfire-us.pydantic.dev.
+	BaseURL string
+	// TLSConfig enables TLS on the wire listener when non-nil.
+	TLSConfig *tls.Config
+	// StaticToken is used as the read token for every client when set, without asking clients for a
+	// password.
+	StaticToken string
+	// ProjectMap maps database names to the read token of a Logfire project. Clients connecting to a
+	// mapped database use its token instead of their password.
+	ProjectMap map[string]string
+	// ProjectName labels the instance, e.g. with the name of the Logfire project it serves. It is
+	// reported to clients as the application_name server parameter when set.
+	ProjectName string
+	// UserAgent is sent to the Logfire API with every request, logfire-pg/<version> by default.
+	UserAgent string
+	// PGVersion is the PostgreSQL server version advertised to clients, e.g. 17.0. Some clients refuse
+	// to connect to versions older or newer than they support.
+	PGVersion string
+	// AuthMethod is how clients send their password, "password" in clear text or "md5" hashed. MD5
+	// hashed passwords are checked against the tokens of ProjectMap.
+	AuthMethod string
+	// AuthValidation is how the tokens of clients are validated, "query" by running SELECT 1 on Logfire
+	// or "none" to accept them as they are, failing their queries instead if they are invalid.
+	AuthValidation string
+	// AuthCacheTTL skips validating tokens that were successfully validated within the given duration.
+	// Zero disables the cache.
+	AuthCacheTTL time.Duration
+	// RetryPolicy controls how queries failing with transient errors are retried.
+	RetryPolicy retryPolicy
+	// QueryTimeout cancels queries running longer than the given duration. Zero disables the timeout.
+	QueryTimeout time.Duration
+	// SlowQueryThreshold logs queries taking longer than the given duration. Zero disables logging.
+	SlowQueryThreshold time.Duration
+	// AuditLogPath appends a JSON line for every query to the file at the given path when set.
+	AuditLogPath string
+	// AuditLogMaxBytes rotates the audit log once it grows beyond the given size.
+	AuditLogMaxBytes int64
+	// MaxRows cancels queries returning more than the given number of rows. Zero means unlimited.
+	MaxRows int
+	// ArrowBufferSize is the size in bytes of the buffer responses of the Logfire API are read through.
+	// Zero reads them unbuffered.
+	ArrowBufferSize int
+	// MaxResponseBytes cancels queries whose response from the Logfire API is larger than the given
+	// number of bytes. Zero means unlimited.
+	MaxResponseBytes int64
+	// MaxQuerySize rejects queries longer than the given number of bytes before they are forwarded to
+	// the Logfire API. Zero means unlimited.
+	MaxQuerySize int
+	// MaxConnections rejects clients once the given number of clients are connected. Zero means unlimited.
+	MaxConnections int
+	// MaxIdleConns is the maximum number of idle keep-alive connections to the Logfire API.
+	MaxIdleConns int
+	// IdleConnTimeout closes idle keep-alive connections to the Logfire API after the given duration.
+	IdleConnTimeout time.Duration
+	// DryRun accepts every client and logs its queries, answering them with empty results without
+	// making any request to the Logfire API.
+	DryRun bool
 }
 
 type readTokenCtxKey struct{}
 
 func main() {
-	var host string
+	var configPath string
+	var showConfigExample bool
+	var bindAddresses []string
+	var hosts []string
 	var port int
+	var socketDir string
+	var noTCP bool
+	var region string
+	var projectMap []string
+	var projectName string
+	var authMethod string
+	var authValidation string
+	var token string
+	var tokenFromEnv bool
+	var tokenFile string
+	var tokenFileReloadInterval time.Duration
+	var baseURL string
+	var queryTimeout time.Duration
+	var maxRows int
+	var arrowBufferSize int
+	var maxResponseBytes int64
+	var maxQuerySize int
+	var auditLogPath string
+	var auditLogMaxMB int
+	var slowQueryThreshold time.Duration
+	var maxRetries int
+	var retryBaseMs int
+	var maxRetryWait time.Duration
+	var maxConnections int
+	var authCacheTTL time.Duration
+	var maxIdleConns int
+	var idleConnTimeout time.Duration
+	var metricsAddr string
+	var healthAddr string
+	var otelEndpoint string
+	var otelServiceName string
+	var tlsCert string
+	var tlsKey string
+	var tlsClientCA string
+	var tlsSkipVerify bool
+	var logFormat string
+	var logLevel string
+	var shutdownTimeout time.Duration
+	var dryRun bool
+	var versionString string
+	var userAgent string
 	var showVersion bool
 	var showHelp bool
 
-	flag.StringVar(&host, "host", "127.0.0.1", "Host to listen on")
+	flag.StringVar(&configPath, "config", "", "Path to a YAML config file (default: logfire-pg/config.yaml in the user config directory)")
+	flag.BoolVar(&showConfigExample, "config-example", false, "Print an example config file and exit")
+	flag.StringArrayVar(&bindAddresses, "bind-address", []string{"127.0.0.1"}, "Address to listen on, IPv6 addresses may be enclosed in brackets, e.g. [::1] (repeatable)")
+	flag.StringArrayVar(&hosts, "host", nil, "Deprecated alias of --bind-address")
 	flag.IntVar(&port, "port", 5432, "Port to listen on")
+	flag.StringVar(&socketDir, "socket-dir", "", "Also listen on a Unix domain socket in the given directory, named .s.PGSQL.<port> like PostgreSQL's")
+	flag.BoolVar(&noTCP, "no-tcp", false, "Only listen on the Unix domain socket of --socket-dir")
+	flag.StringVar(&region, "region", "us", "Logfire region to query (us or eu)")
+	flag.StringVar(&token, "token", "", "Logfire read token used for every client, which then connect without a password. Prefer setting LOGFIRE_PG_TOKEN to keep the token out of the process arguments")
+	flag.BoolVar(&tokenFromEnv, "token-from-env", false, "Use the read token of the LOGFIRE_TOKEN environment variable of the Logfire SDKs as static token, falling back to --token")
+	flag.StringVar(&tokenFile, "token-file", "", "Read the static token from the given file instead of --token")
+	flag.DurationVar(&tokenFileReloadInterval, "token-file-reload-interval", 0, "Re-read --token-file at the given interval to pick up rotated tokens, 0 disables reloading")
+	flag.StringArrayVar(&projectMap, "project-map", nil, "Map a database name to a Logfire read token as dbname:token, used instead of the client's password (repeatable)")
+	flag.StringVar(&authMethod, "auth-method", "password", "How clients send their password: password sends it in clear text, md5 hashed for older clients, which requires --project-map and the mapped token as password")
+	flag.StringVar(&authValidation, "auth-validation", "query", "How tokens of clients are validated: query runs SELECT 1 on Logfire, which counts towards its query quota, none accepts them without validation for deployments where tokens are known to be valid")
+	flag.StringVar(&projectName, "project-name", "", "Label added to every log line and reported to clients as application_name, to tell apart instances serving different Logfire projects")
+	flag.StringVar(&baseURL, "base-url", "", "Base URL of the Logfire API, overrides --region")
+	flag.DurationVar(&queryTimeout, "query-timeout", 60*time.Second, "Cancel queries running longer than the given duration, 0 disables the timeout")
+	flag.DurationVar(&slowQueryThreshold, "slow-query-threshold", 0, "Log queries taking longer than the given duration, 0 disables slow query logging")
+	flag.StringVar(&auditLogPath, "audit-log", "", "Path of a file to append a JSON line to for every statement received from clients (disabled by default)")
+	flag.IntVar(&auditLogMaxMB, "audit-log-max-mb", 100, "Rotate the audit log once it grows beyond the given size in megabytes; it is also rotated at midnight")
+	flag.IntVar(&maxRows, "max-rows", 0, "Cancel queries returning more than the given number of rows, 0 means unlimited")
+	flag.IntVar(&arrowBufferSize, "arrow-buffer-size", 4<<20, "Size in bytes of the buffer Arrow results are read through for every query. Larger buffers need fewer reads on slow or high-latency connections to Logfire, smaller ones use less memory with many concurrent queries")
+	flag.Int64Var(&maxResponseBytes, "max-response-bytes", 512<<20, "Cancel queries whose response from Logfire is larger than the given number of bytes, to bound the memory a single query can use, 0 means unlimited")
+	flag.IntVar(&maxQuerySize, "max-query-size", 1<<20, "Reject queries longer than the given number of bytes before forwarding them to Logfire, 0 means unlimited")
+	flag.IntVar(&maxRetries, "max-retries", 3, "Number of times a query failing with a transient error is retried")
+	flag.IntVar(&retryBaseMs, "retry-base-ms", 200, "Delay in milliseconds before the first retry, doubled for every subsequent retry")
+	flag.DurationVar(&maxRetryWait, "max-retry-wait", 30*time.Second, "Maximum time to wait before retrying a query rate limited by Logfire, even if its Retry-After header asks for longer")
+	flag.DurationVar(&authCacheTTL, "auth-cache-ttl", 5*time.Minute, "Skip validating tokens that were successfully validated within the given duration, 0 disables the cache")
+	flag.IntVar(&maxConnections, "max-connections", 0, "Maximum number of concurrent client connections, 0 means unlimited")
+	flag.IntVar(&maxIdleConns, "max-idle-conns", 100, "Maximum number of idle keep-alive connections to the Logfire API")
+	flag.DurationVar(&idleConnTimeout, "idle-conn-timeout", 90*time.Second, "Close idle connections to the Logfire API after the given duration")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Address to serve Prometheus metrics on, e.g. :9187 (disabled by default)")
+	flag.StringVar(&healthAddr, "health-addr", "", "Address to serve the /healthz and /readyz probes on, e.g. :8080 (disabled by default)")
+	flag.StringVar(&otelEndpoint, "otel-endpoint", "", "OTLP/HTTP endpoint to export query traces to, e.g. http://localhost:4318/v1/traces (disabled by default)")
+	flag.StringVar(&otelServiceName, "otel-service-name", "logfire-pg", "Service name reported in exported traces")
+	flag.StringVar(&tlsCert, "tls-cert", "", "Path to a PEM encoded TLS certificate (requires --tls-key)")
+	flag.StringVar(&tlsKey, "tls-key", "", "Path to a PEM encoded TLS private key (requires --tls-cert)")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "Path to PEM encoded CA certificates that clients must present a certificate signed by (requires --tls-cert)")
+	flag.BoolVar(&tlsSkipVerify, "tls-skip-verify", false, "Deprecated, certificates presented by clients are ignored unless --tls-client-ca is set")
+	flag.StringVar(&logFormat, "log-format", "text", "Format of the log output (text or json)")
+	flag.StringVar(&logLevel, "log-level", "info", "Minimum level of log output (debug, info, warn or error)")
+	flag.BoolVar(&dryRun, "dry-run", false, "Accept every client and log its queries, answering them with empty results without making requests to Logfire")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "Time to wait for in-flight queries to finish when shutting down")
+	flag.StringVar(&userAgent, "user-agent", defaultUserAgent(), "User-Agent header sent to the Logfire API")
+	flag.StringVar(&versionString, "version-string", defaultPGVersion, "PostgreSQL server version advertised to clients, for clients requiring a specific version, e.g. 14.5")
 	flag.BoolVar(&showVersion, "version", false, "Print version and exit")
 	flag.BoolVar(&showHelp, "help", false, "Print this help message and exit")
+	// pflag prints the notice whenever --host is set, from the command line, environment or config file
+	flag.CommandLine.MarkDeprecated("host", "use --bind-address instead")
+	flag.CommandLine.MarkDeprecated("tls-skip-verify", "certificates presented by clients are ignored unless --tls-client-ca is set")
 	flag.Parse()
 
 	if showVersion {
@@ -55,19 +269,392 @@ func main() {
 		os.Exit(0)
 	}
 
-	logger := log.New(os.Stdout, "[logfire-pg] ", log.LstdFlags)
-	server, err := NewPostgreServer(logger)
+	if showConfigExample {
+		fmt.Print(exampleConfig)
+		os.Exit(0)
+	}
+
+	// Replaced once --log-format is known, which may be set through the environment or config file
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	if err := applyEnv(flag.CommandLine); err != nil {
+		fatal(logger, "failed to load environment", "err", err)
+	}
+
+	if configPath != "" {
+		err := applyConfigFile(flag.CommandLine, configPath, true)
+		if err != nil {
+			fatal(logger, "failed to load config", "err", err)
+		}
+	} else if path := defaultConfigPath(); path != "" {
+		err := applyConfigFile(flag.CommandLine, path, false)
+		if err != nil {
+			fatal(logger, "failed to load config", "err", err)
+		}
+	}
+
+	var level slog.LevelVar
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		fatal(logger, "invalid --log-level, expected one of: debug, info, warn, error", "level", logLevel)
+	}
+
+	configuredLogger, err := newLogger(os.Stdout, logFormat, &level)
 	if err != nil {
-		logger.Fatalf("failed to create server: %s", err)
+		fatal(logger, "invalid --log-format", "err", err)
+	}
+	logger = configuredLogger
+	if projectName != "" {
+		logger = logger.With("project", projectName)
+	}
+
+	if baseURL == "" {
+		var ok bool
+		baseURL, ok = regionBaseURLs[region]
+		if !ok {
+			fatal(logger, "unknown region, expected one of: us, eu", "region", region)
+		}
+	}
+
+	projects, err := parseProjectMap(projectMap)
+	if err != nil {
+		fatal(logger, "invalid --project-map", "err", err)
+	}
+
+	if tokenFromEnv {
+		if tokenFile != "" {
+			fatal(logger, "--token-from-env and --token-file are mutually exclusive")
+		}
+
+		if sdkToken := os.Getenv(sdkTokenEnv); sdkToken != "" {
+			// The variable is set for the Logfire SDKs, which usually expect a write token
+			logger.Warn("using the token of the " + sdkTokenEnv + " environment variable as static token, clients connect without a password")
+			token = sdkToken
+		} else if token == "" {
+			fatal(logger, "--token-from-env requires "+sdkTokenEnv+", LOGFIRE_PG_TOKEN or --token to be set")
+		}
+	}
+
+	if tokenFile != "" {
+		if token != "" {
+			fatal(logger, "--token and --token-file are mutually exclusive")
+		}
+
+		token, err = readTokenFile(tokenFile)
+		if err != nil {
+			fatal(logger, "failed to read token file", "err", err)
+		}
+	}
+
+	if token != "" && len(projects) > 0 {
+		fatal(logger, "--token and --project-map are mutually exclusive")
+	}
+
+	switch authMethod {
+	case "password":
+	case "md5":
+		// The hashed password cannot be forwarded to Logfire, only compared to a known token
+		if len(projects) == 0 {
+			fatal(logger, "--auth-method md5 requires --project-map")
+		}
+	default:
+		fatal(logger, "unknown --auth-method, expected one of: password, md5", "auth_method", authMethod)
+	}
+
+	if authValidation != "query" && authValidation != "none" {
+		fatal(logger, "unknown --auth-validation, expected one of: query, none", "auth_validation", authValidation)
+	}
+
+	cfg := serverConfig{
+		BaseURL:        strings.TrimRight(baseURL, "/"),
+		StaticToken:    token,
+		ProjectMap:     projects,
+		ProjectName:    projectName,
+		PGVersion:      versionString,
+		UserAgent:      userAgent,
+		AuthMethod:     authMethod,
+		AuthValidation: authValidation,
+		AuthCacheTTL:   authCacheTTL,
+		RetryPolicy: retryPolicy{
+			MaxRetries: maxRetries,
+			BaseDelay:  time.Duration(retryBaseMs) * time.Millisecond,
+			MaxWait:    maxRetryWait,
+		},
+		QueryTimeout:       queryTimeout,
+		MaxRows:            maxRows,
+		ArrowBufferSize:    arrowBufferSize,
+		MaxResponseBytes:   maxResponseBytes,
+		MaxQuerySize:       maxQuerySize,
+		SlowQueryThreshold: slowQueryThreshold,
+		AuditLogPath:       auditLogPath,
+		AuditLogMaxBytes:   int64(auditLogMaxMB) * 1024 * 1024,
+		MaxConnections:     maxConnections,
+		MaxIdleConns:       maxIdleConns,
+		IdleConnTimeout:    idleConnTimeout,
+		DryRun:             dryRun,
+	}
+
+	if (tlsCert == "") != (tlsKey == "") {
+		fatal(logger, "both --tls-cert and --tls-key must be provided to enable TLS")
+	}
+
+	if tlsClientCA != "" && tlsCert == "" {
+		fatal(logger, "--tls-client-ca requires --tls-cert and --tls-key")
+	}
+
+	if tlsCert != "" {
+		tlsConfig, err := loadTLSConfig(tlsCert, tlsKey, tlsClientCA)
+		if err != nil {
+			fatal(logger, "failed to load TLS certificate", "err", err)
+		}
+		cfg.TLSConfig = tlsConfig
+	}
+
+	server, err := NewPostgreServer(logger, cfg)
+	if err != nil {
+		fatal(logger, "failed to create server", "err", err)
+	}
+
+	if tokenFile != "" && tokenFileReloadInterval > 0 {
+		go server.reloadTokenFile(tokenFile, tokenFileReloadInterval)
+	}
+
+	if otelEndpoint != "" {
+		shutdownTracing, err := setupTracing(context.Background(), otelEndpoint, otelServiceName)
+		if err != nil {
+			fatal(logger, "failed to set up tracing", "err", err)
+		}
+		defer shutdownTracing(context.Background())
+	}
+
+	if metricsAddr != "" {
+		go func() {
+			logger.Info("serving metrics", "addr", metricsAddr)
+			if err := serveMetrics(metricsAddr); err != nil {
+				fatal(logger, "failed to serve metrics", "err", err)
+			}
+		}()
+	}
+
+	// --host is still honored for existing deployments, together with --bind-address if both are set
+	if flag.CommandLine.Changed("host") {
+		if flag.CommandLine.Changed("bind-address") {
+			bindAddresses = append(bindAddresses, hosts...)
+		} else {
+			bindAddresses = hosts
+		}
+	}
+
+	if noTCP && socketDir == "" {
+		fatal(logger, "--no-tcp requires --socket-dir")
+	}
+
+	var listeners []net.Listener
+	if !noTCP {
+		for _, host := range bindAddresses {
+			addr := listenAddress(host, port)
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				fatal(logger, "failed to start server", "addr", addr, "err", err)
+			}
+			listeners = append(listeners, listener)
+		}
+	}
+
+	if socketDir != "" {
+		path := filepath.Join(socketDir, fmt.Sprintf(".s.PGSQL.%d", port))
+		listener, err := listenUnix(path)
+		if err != nil {
+			fatal(logger, "failed to start server", "addr", path, "err", err)
+		}
+		listeners = append(listeners, listener)
 	}
 
+	// Started once the listeners are open, so that the server is only reported healthy when accepting
+	// connections
+	if healthAddr != "" {
+		go func() {
+			logger.Info("serving health checks", "addr", healthAddr)
+			if err := server.serveHealth(healthAddr); err != nil {
+				fatal(logger, "failed to serve health checks", "err", err)
+			}
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		// A second signal terminates the process immediately
+		stop()
+
+		logger.Info("shutting down, waiting for in-flight queries to finish", "timeout", shutdownTimeout)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("shutdown did not complete cleanly", "err", err)
+		}
+		logger.Info("shutdown complete")
+	}()
+
 	fmt.Println("Starting pg_logfire...")
-	err = server.server.ListenAndServe(fmt.Sprintf("%s:%d", host, port))
+	serveErrs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func() {
+			serveErrs <- server.Serve(listener)
+		}()
+	}
+	for range listeners {
+		if err := <-serveErrs; err != nil {
+			fatal(logger, "failed to start server", "err", err)
+		}
+	}
+	<-shutdownDone
+}
+
+// listenAddress returns the TCP address to listen on for the given --bind-address and port. IPv6
+// addresses may be enclosed in brackets, e.g. [::1].
+func listenAddress(host string, port int) string {
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), strconv.Itoa(port))
+}
+
+// listenUnix listens on a Unix domain socket at the given path. A socket left behind by a server that
+// did not shut down cleanly is replaced, unless another server is still listening on it.
+func listenUnix(path string) (net.Listener, error) {
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("another server is already listening on %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return net.Listen("unix", path)
+}
+
+// parseProjectMap parses dbname:token pairs into a map from database name to token.
+func parseProjectMap(pairs []string) (map[string]string, error) {
+	projects := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		database, token, ok := strings.Cut(pair, ":")
+		if !ok || database == "" || token == "" {
+			return nil, fmt.Errorf("expected dbname:token, got %q", pair)
+		}
+		projects[database] = token
+	}
+	return projects, nil
+}
+
+// readTokenFile reads a token from the file at the given path, ignoring surrounding whitespace.
+func readTokenFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// reloadTokenFile re-reads the static token from the file at the given path at every interval. The
+// previous token is kept if the file cannot be read.
+func (s *PostgreServer) reloadTokenFile(path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		token, err := readTokenFile(path)
+		if err != nil {
+			s.logger.Warn("failed to reload token file, keeping the previous token", "err", err)
+			continue
+		}
+
+		if previous := s.staticToken.Swap(token); previous != token {
+			s.logger.Info("reloaded token from token file", "path", path)
+		}
+	}
+}
+
+// loadTLSConfig loads the given certificate/key pair into a TLS config usable by the wire listener.
+// Clients authenticate with their read token, so the certificates they present are ignored, unless
+// clientCAFile is set, in which case clients must present a certificate signed by one of its CAs.
+func loadTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
-		logger.Fatalf("failed to start server: %s", err)
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		// libpq presents ~/.postgresql/postgresql.crt whenever it exists, which must not fail the
+		// handshake
+		ClientAuth: tls.NoClientCert,
+		MinVersion: tls.VersionTLS12,
 	}
+
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM encoded certificates found in %s", clientCAFile)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
 }
 
+// psqlCommandHints holds additional explanations, keyed by psql command, that are sent along with the
+// suggested query when a psql command is detected.
+var psqlCommandHints = map[string]string{
+	"\\d":  "psql sends the same query for \\d+, whose extended information such as column descriptions and storage is not available.",
+	"\\d+": "The extended information of \\d+ such as descriptions, sizes and access methods is not available.",
+	"\\l":  "Logfire has no separate databases: each read token is scoped to a single project. Connect with a read token of another project to query it.",
+	"\\dn": "Logfire does not expose separate schemas; all tables are in the default namespace.",
+	"\\dv": "Logfire does not expose views; all queryable relations are listed as tables.",
+	"\\ef": "Logfire has no user-defined functions that could be edited or shown.",
+	"\\ev": "Logfire does not expose views that could be edited or shown.",
+}
+
+// psqlListDatabasesPattern matches the query psql runs for \l.
+var psqlListDatabasesPattern = regexp.MustCompile(`^SELECT d\.datname as "Name", pg_catalog\.pg_get_userbyid\(d\.datdba\) as "Owner", .* FROM pg_catalog\.pg_database d ORDER BY 1;$`)
+
+// psqlListSchemasPattern matches the query psql runs for \dn.
+var psqlListSchemasPattern = regexp.MustCompile(`^SELECT n\.nspname AS "Name", pg_catalog\.pg_get_userbyid\(n\.nspowner\) AS "Owner".* FROM pg_catalog\.pg_namespace n .*ORDER BY 1;$`)
+
+// psqlListViewsPattern matches the query psql runs for \dv.
+var psqlListViewsPattern = regexp.MustCompile(`^SELECT n\.nspname as "Schema", c\.relname as "Name", CASE c\.relkind .* FROM pg_catalog\.pg_class c .*WHERE c\.relkind IN \('v',''\) .*ORDER BY 1,2;$`)
+
+// psqlListVerbosePattern matches the query psql runs for \d+ and \dt+, which list the relations along
+// with their size and description.
+var psqlListVerbosePattern = regexp.MustCompile(`^SELECT n\.nspname as "Schema", c\.relname as "Name", CASE c\.relkind .* pg_catalog\.obj_description\(c\.oid, 'pg_class'\) as "Description" FROM pg_catalog\.pg_class c .*ORDER BY 1,2;$`)
+
+// psqlDescribePattern matches the query psql runs for \d <table>, capturing the table name.
+var psqlDescribePattern = regexp.MustCompile(`^SELECT c\.oid, n\.nspname, c\.relname FROM pg_catalog\.pg_class c LEFT JOIN pg_catalog\.pg_namespace n ON n\.oid = c\.relnamespace WHERE c\.relname OPERATOR\(pg_catalog\.\~\) '\^\(([^)]+)\)\$' COLLATE pg_catalog\.default AND pg_catalog\.pg_table_is_visible\(c\.oid\) ORDER BY 2, 3;$`)
+
+// psqlDescribeSchemaPattern matches the query psql runs for \d <schema>.<table>, capturing the table
+// and schema names.
+var psqlDescribeSchemaPattern = regexp.MustCompile(`^SELECT c\.oid, n\.nspname, c\.relname FROM pg_catalog\.pg_class c LEFT JOIN pg_catalog\.pg_namespace n ON n\.oid = c\.relnamespace WHERE c\.relname OPERATOR\(pg_catalog\.\~\) '\^\(([^)]+)\)\$' COLLATE pg_catalog\.default AND n\.nspname OPERATOR\(pg_catalog\.\~\) '\^\(([^)]+)\)\$' COLLATE pg_catalog\.default ORDER BY 2, 3;$`)
+
+// psqlFunctionLookupPattern matches the queries psql runs for \ef and \sf, looking up the function
+// to edit or show, and fetching its definition.
+var psqlFunctionLookupPattern = regexp.MustCompile(`^SELECT (?:'(?:[^']|'')*'::pg_catalog\.regproc(?:edure)?::pg_catalog\.oid|pg_catalog\.pg_get_functiondef\(\d+\))$`)
+
+// psqlViewLookupPattern matches the queries psql runs for \ev and \sv, looking up the view to edit
+// or show, and fetching its definition.
+var psqlViewLookupPattern = regexp.MustCompile(`^SELECT (?:'(?:[^']|'')*'::pg_catalog\.regclass::pg_catalog\.oid|nspname, relname, relkind, pg_catalog\.pg_get_viewdef\(c\.oid, true\).* WHERE c\.oid = \d+)$`)
+
 func DetectPsqlCommandQuery(query string) (detectedCommand string, suggestedQuery string, isPsqlCommand bool) {
 	// Normalize whitespace for comparison
 	normalized := strings.Join(strings.Fields(query), " ")
@@ -79,18 +666,34 @@ func DetectPsqlCommandQuery(query string) (detectedCommand string, suggestedQuer
 		return "\\dt", "show tables;", true
 	}
 
-	// Check for \d <table> command pattern (without schema)
-	dPattern := regexp.MustCompile(`^SELECT c\.oid, n\.nspname, c\.relname FROM pg_catalog\.pg_class c LEFT JOIN pg_catalog\.pg_namespace n ON n\.oid = c\.relnamespace WHERE c\.relname OPERATOR\(pg_catalog\.\~\) '\^\(([^)]+)\)\$' COLLATE pg_catalog\.default AND pg_catalog\.pg_table_is_visible\(c\.oid\) ORDER BY 2, 3;$`)
+	// Check for \l command pattern
+	if psqlListDatabasesPattern.MatchString(normalized) {
+		return "\\l", "show tables;", true
+	}
 
-	if matches := dPattern.FindStringSubmatch(normalized); matches != nil {
+	// Check for \dn command pattern
+	if psqlListSchemasPattern.MatchString(normalized) {
+		return "\\dn", "show tables;", true
+	}
+
+	// Check for \dv command pattern
+	if psqlListViewsPattern.MatchString(normalized) {
+		return "\\dv", "show tables;", true
+	}
+
+	// Check for \d+ command pattern, without a table name. \d+ <table> runs the same query as \d <table>
+	if psqlListVerbosePattern.MatchString(normalized) {
+		return "\\d+", "show tables;", true
+	}
+
+	// Check for \d <table> command pattern (without schema)
+	if matches := psqlDescribePattern.FindStringSubmatch(normalized); matches != nil {
 		tableName := matches[1]
 		return fmt.Sprintf("\\d %s", tableName), fmt.Sprintf("show columns from %s;", tableName), true
 	}
 
 	// Check for \d <schema.table> command pattern (with schema)
-	dSchemaPattern := regexp.MustCompile(`^SELECT c\.oid, n\.nspname, c\.relname FROM pg_catalog\.pg_class c LEFT JOIN pg_catalog\.pg_namespace n ON n\.oid = c\.relnamespace WHERE c\.relname OPERATOR\(pg_catalog\.\~\) '\^\(([^)]+)\)\$' COLLATE pg_catalog\.default AND n\.nspname OPERATOR\(pg_catalog\.\~\) '\^\(([^)]+)\)\$' COLLATE pg_catalog\.default ORDER BY 2, 3;$`)
-
-	if matches := dSchemaPattern.FindStringSubmatch(normalized); matches != nil {
+	if matches := psqlDescribeSchemaPattern.FindStringSubmatch(normalized); matches != nil {
 		tableName := matches[1]
 		schemaName := matches[2]
 		return fmt.Sprintf("\\d %s.%s", schemaName, tableName), fmt.Sprintf("show columns from %s.%s;", schemaName, tableName), true
@@ -99,41 +702,122 @@ func DetectPsqlCommandQuery(query string) (detectedCommand string, suggestedQuer
 	return "", "", false
 }
 
-func executeQuery(sql string, token string) (io.ReadCloser, error) {
-	req, err := http.NewRequest("GET", queryUrl, nil)
+// detectUnsupportedPsqlCommand returns the psql command the given query was run for, if it is one
+// without an equivalent query that DetectPsqlCommandQuery could suggest instead.
+func detectUnsupportedPsqlCommand(query string) (detectedCommand string, isPsqlCommand bool) {
+	normalized := strings.Join(strings.Fields(query), " ")
+
+	if psqlFunctionLookupPattern.MatchString(normalized) {
+		return "\\ef", true
+	}
+	if psqlViewLookupPattern.MatchString(normalized) {
+		return "\\ev", true
+	}
+
+	return "", false
+}
+
+// queryError is returned by executeQuery when the Logfire API responds with a non-200 status code.
+type queryError struct {
+	StatusCode int
+	Body       string
+	// RetryAfter is the delay asked for by the Retry-After header of a 429 response, if any.
+	RetryAfter time.Duration
+}
+
+func (e *queryError) Error() string {
+	return fmt.Sprintf("query failed. Status code: %d, body: %s", e.StatusCode, e.Body)
+}
+
+// executeQuery sends the given query to the Logfire API and returns the Arrow stream of its result.
+func executeQuery(ctx context.Context, client *http.Client, baseURL string, userAgent string, sql string, token string) (_ io.ReadCloser, err error) {
+	ctx, span := tracer.Start(ctx, "logfire_pg.http_request", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { endSpan(span, err) }()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL+"/v1/query", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("Accept", "application/vnd.apache.arrow.stream")
+	req.Header.Set("User-Agent", userAgent)
+	setCorrelationHeaders(ctx, req.Header)
 
 	q := req.URL.Query()
 	q.Add("sql", sql)
 	req.URL.RawQuery = q.Encode()
 
-	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute query: %w", err)
 	}
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
 
 	if resp.StatusCode != 200 {
 		body, _ := io.ReadAll(resp.Body)
 		resp.Body.Close()
-		return nil, fmt.Errorf("query failed. Status code: %d, body: %s", resp.StatusCode, string(body))
+		return nil, &queryError{StatusCode: resp.StatusCode, Body: string(body), RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
 	}
 
 	// Return the response body as a stream
 	return resp.Body, nil
 }
 
+// limitedBody is a response body of the Logfire API limited to a maximum number of bytes. Unlike
+// io.LimitReader, reading past the limit fails with errResponseTooLarge rather than io.EOF, so that
+// a truncated response is not mistaken for a complete one.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		// A response of exactly the maximum size is not too large
+		var probe [1]byte
+		if n, err := b.ReadCloser.Read(probe[:]); n == 0 {
+			return 0, err
+		}
+		return 0, errResponseTooLarge
+	}
+
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// newHTTPClient returns the client used for requests to the Logfire API. Connections are kept alive
+// and reused across queries to avoid a TCP and TLS handshake per query.
+func newHTTPClient(maxIdleConns int, idleConnTimeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = maxIdleConns
+	// All requests go to the same host, so the per-host limit (2 by default) has to be raised as well
+	transport.MaxIdleConnsPerHost = maxIdleConns
+	transport.IdleConnTimeout = idleConnTimeout
+	transport.DisableKeepAlives = false
+	return &http.Client{Transport: transport}
+}
+
 func arrowTypeToPgOid(dt arrow.DataType) (oid.Oid, error) {
 	switch dt.ID() {
-	case arrow.STRING, arrow.LARGE_STRING:
+	case arrow.STRING, arrow.LARGE_STRING, arrow.STRING_VIEW:
 		return oid.T_text, nil
+	case arrow.BINARY, arrow.LARGE_BINARY, arrow.BINARY_VIEW:
+		return oid.T_bytea, nil
+	case arrow.FIXED_SIZE_BINARY:
+		// 16 byte values are UUIDs
+		if dt.(*arrow.FixedSizeBinaryType).ByteWidth == 16 {
+			return oid.T_uuid, nil
+		}
+		return oid.T_bytea, nil
 	case arrow.BOOL:
 		return oid.T_bool, nil
+	case arrow.INT8, arrow.INT16, arrow.UINT8:
+		return oid.T_int2, nil
 	case arrow.INT32:
 		return oid.T_int4, nil
 	case arrow.INT64:
@@ -143,42 +827,125 @@ func arrowTypeToPgOid(dt arrow.DataType) (oid.Oid, error) {
 	case arrow.UINT32:
 		return oid.T_int8, nil
 	case arrow.UINT64:
-		return oid.T_int8, nil
+		// Values above math.MaxInt64 do not fit in a bigint
+		return oid.T_numeric, nil
+	case arrow.FLOAT16, arrow.FLOAT32:
+		return oid.T_float4, nil
 	case arrow.FLOAT64:
 		return oid.T_float8, nil
-	case arrow.DATE32:
+	case arrow.DATE32, arrow.DATE64:
 		return oid.T_date, nil
+	case arrow.TIME32, arrow.TIME64:
+		return oid.T_time, nil
 	case arrow.TIMESTAMP:
 		return oid.T_timestamptz, nil
-	case arrow.LIST:
-		listType := dt.(*arrow.ListType)
+	case arrow.DECIMAL128, arrow.DECIMAL256:
+		return oid.T_numeric, nil
+	case arrow.DURATION, arrow.INTERVAL_MONTHS, arrow.INTERVAL_DAY_TIME, arrow.INTERVAL_MONTH_DAY_NANO:
+		return oid.T_interval, nil
+	case arrow.STRUCT:
+		return oid.T_jsonb, nil
+	case arrow.MAP:
+		return oid.T_jsonb, nil
+	case arrow.EXTENSION:
+		ext := dt.(arrow.ExtensionType)
+		if typ, ok := extensionTypeOids[ext.ExtensionName()]; ok {
+			return typ, nil
+		}
+		return arrowTypeToPgOid(ext.StorageType())
+	case arrow.DICTIONARY:
+		return arrowTypeToPgOid(dt.(*arrow.DictionaryType).ValueType)
+	case arrow.RUN_END_ENCODED:
+		return arrowTypeToPgOid(dt.(*arrow.RunEndEncodedType).Encoded())
+	case arrow.LIST, arrow.LARGE_LIST:
+		listType := dt.(arrow.ListLikeType)
 		innerOid, err := arrowTypeToPgOid(listType.Elem())
 		if err != nil {
 			return 0, err
 		}
-		// Convert to array OID (add underscore prefix)
-		switch innerOid {
-		case oid.T_text:
-			return oid.T__text, nil
-		case oid.T_bool:
-			return oid.T__bool, nil
-		case oid.T_int4:
-			return oid.T__int4, nil
-		case oid.T_int8:
-			return oid.T__int8, nil
-		case oid.T_float8:
-			return oid.T__float8, nil
-		case oid.T_date:
-			return oid.T__date, nil
-		default:
+		arrayOid, ok := pgArrayOid(innerOid)
+		if !ok {
 			return 0, fmt.Errorf("unsupported list inner type: %v", innerOid)
 		}
+		return arrayOid, nil
+	case arrow.FIXED_SIZE_LIST:
+		listType := dt.(*arrow.FixedSizeListType)
+		innerOid, err := arrowTypeToPgOid(listType.Elem())
+		if err != nil {
+			return 0, err
+		}
+		arrayOid, ok := pgArrayOid(innerOid)
+		if !ok {
+			// Elements without a PostgreSQL array type are returned as a JSON array instead
+			return oid.T_jsonb, nil
+		}
+		return arrayOid, nil
 	default:
 		return 0, fmt.Errorf("unsupported arrow type: %v", dt)
 	}
 }
 
-func arrowValueToInterface(col arrow.Array, rowIdx int) (interface{}, error) {
+// extensionTypeOids maps the names of Arrow extension types to the PostgreSQL types their values are
+// returned as. Other extension types are returned as their storage type.
+var extensionTypeOids = map[string]oid.Oid{
+	"uuid":       oid.T_uuid,
+	"arrow.uuid": oid.T_uuid,
+	"json":       oid.T_jsonb,
+	"arrow.json": oid.T_jsonb,
+}
+
+// arrowFieldToPgOid maps the type of the given Arrow field to a PostgreSQL type OID. Extension types
+// that are not registered with the Arrow library are read as their storage type, with the extension
+// name kept in the field metadata.
+func arrowFieldToPgOid(field arrow.Field) (oid.Oid, error) {
+	if name, ok := field.Metadata.GetValue(ipc.ExtensionTypeKeyName); ok {
+		if typ, ok := extensionTypeOids[name]; ok {
+			return typ, nil
+		}
+	}
+	return arrowTypeToPgOid(field.Type)
+}
+
+// metadataAttrs returns the given Arrow metadata as a log attribute value.
+func metadataAttrs(md arrow.Metadata) slog.Value {
+	attrs := make([]slog.Attr, md.Len())
+	for i, key := range md.Keys() {
+		attrs[i] = slog.String(key, md.Values()[i])
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// pgArrayOid returns the OID of the PostgreSQL array type with the given element type.
+func pgArrayOid(elem oid.Oid) (oid.Oid, bool) {
+	switch elem {
+	case oid.T_text:
+		return oid.T__text, true
+	case oid.T_bool:
+		return oid.T__bool, true
+	case oid.T_int2:
+		return oid.T__int2, true
+	case oid.T_int4:
+		return oid.T__int4, true
+	case oid.T_int8:
+		return oid.T__int8, true
+	case oid.T_float4:
+		return oid.T__float4, true
+	case oid.T_float8:
+		return oid.T__float8, true
+	case oid.T_date:
+		return oid.T__date, true
+	case oid.T_numeric:
+		return oid.T__numeric, true
+	case oid.T_interval:
+		return oid.T__interval, true
+	default:
+		return 0, false
+	}
+}
+
+// arrowValueToInterface returns the value at the given row as it is sent to clients. Timestamps are
+// formatted in the given location, the time zone of the session.
+func arrowValueToInterface(col arrow.Array, rowIdx int, loc *time.Location) (interface{}, error) {
 	if col.IsNull(rowIdx) {
 		return nil, nil
 	}
@@ -186,8 +953,28 @@ func arrowValueToInterface(col arrow.Array, rowIdx int) (interface{}, error) {
 	switch arr := col.(type) {
 	case *array.String:
 		return arr.Value(rowIdx), nil
+	case *array.StringView:
+		return arr.Value(rowIdx), nil
+	case *array.Binary:
+		return arr.Value(rowIdx), nil
+	case *array.LargeBinary:
+		return arr.Value(rowIdx), nil
+	case *array.BinaryView:
+		return arr.Value(rowIdx), nil
+	case *array.FixedSizeBinary:
+		b := arr.Value(rowIdx)
+		if len(b) == 16 {
+			return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+		}
+		return b, nil
 	case *array.Boolean:
 		return arr.Value(rowIdx), nil
+	case *array.Int8:
+		return float64(arr.Value(rowIdx)), nil
+	case *array.Int16:
+		return float64(arr.Value(rowIdx)), nil
+	case *array.Uint8:
+		return float64(arr.Value(rowIdx)), nil
 	case *array.Int32:
 		return float64(arr.Value(rowIdx)), nil
 	case *array.Int64:
@@ -197,20 +984,51 @@ func arrowValueToInterface(col arrow.Array, rowIdx int) (interface{}, error) {
 	case *array.Uint32:
 		return float64(arr.Value(rowIdx)), nil
 	case *array.Uint64:
+		// Formatted as text since a float64 cannot represent large values exactly
+		return strconv.FormatUint(arr.Value(rowIdx), 10), nil
+	case *array.Float16:
+		return float64(arr.Value(rowIdx).Float32()), nil
+	case *array.Float32:
 		return float64(arr.Value(rowIdx)), nil
 	case *array.Float64:
 		return arr.Value(rowIdx), nil
 	case *array.Date32:
 		return arr.Value(rowIdx).FormattedString(), nil
+	case *array.Date64:
+		return time.UnixMilli(int64(arr.Value(rowIdx))).UTC().Format("2006-01-02"), nil
+	case *array.Decimal128:
+		scale := arr.DataType().(*arrow.Decimal128Type).Scale
+		return formatDecimal(arr.Value(rowIdx).BigInt(), scale), nil
+	case *array.Decimal256:
+		scale := arr.DataType().(*arrow.Decimal256Type).Scale
+		return formatDecimal(arr.Value(rowIdx).BigInt(), scale), nil
+	case *array.Time32:
+		unit := arr.DataType().(*arrow.Time32Type).Unit
+		return arr.Value(rowIdx).ToTime(unit).Format("15:04:05.000000"), nil
+	case *array.Time64:
+		unit := arr.DataType().(*arrow.Time64Type).Unit
+		return arr.Value(rowIdx).ToTime(unit).Format("15:04:05.000000"), nil
+	case *array.Duration:
+		unit := arr.DataType().(*arrow.DurationType).Unit
+		return formatInterval(0, 0, time.Duration(arr.Value(rowIdx))*unit.Multiplier()), nil
+	case *array.MonthInterval:
+		return formatInterval(int32(arr.Value(rowIdx)), 0, 0), nil
+	case *array.DayTimeInterval:
+		v := arr.Value(rowIdx)
+		return formatInterval(0, v.Days, time.Duration(v.Milliseconds)*time.Millisecond), nil
+	case *array.MonthDayNanoInterval:
+		v := arr.Value(rowIdx)
+		return formatInterval(v.Months, v.Days, time.Duration(v.Nanoseconds)), nil
 	case *array.Timestamp:
-		return arr.Value(rowIdx).ToTime(arrow.Microsecond).Format("2006-01-02T15:04:05.000000Z"), nil
-	case *array.List:
+		return arr.Value(rowIdx).ToTime(arrow.Microsecond).In(loc).Format("2006-01-02T15:04:05.000000Z07:00"), nil
+	case *array.List, *array.LargeList:
+		list := arr.(array.ListLike)
 		listValues := make([]interface{}, 0)
-		start, end := arr.ValueOffsets(rowIdx)
-		innerArray := arr.ListValues()
+		start, end := list.ValueOffsets(rowIdx)
+		innerArray := list.ListValues()
 
 		for j := range int(end) - int(start) {
-			val, err := arrowValueToInterface(innerArray, int(start)+j)
+			val, err := arrowValueToInterface(innerArray, int(start)+j, loc)
 			if err != nil {
 				return nil, err
 			}
@@ -220,23 +1038,196 @@ func arrowValueToInterface(col arrow.Array, rowIdx int) (interface{}, error) {
 		// Convert to JSON string for PostgreSQL array representation
 		jsonBytes, _ := json.Marshal(listValues)
 		return string(jsonBytes), nil
+	case *array.Dictionary:
+		return arrowValueToInterface(arr.Dictionary(), arr.GetValueIndex(rowIdx), loc)
+	case *array.RunEndEncoded:
+		return arrowValueToInterface(arr.Values(), arr.GetPhysicalIndex(rowIdx), loc)
+	case array.ExtensionArray:
+		return arrowValueToInterface(arr.Storage(), rowIdx, loc)
+	case *array.FixedSizeList, *array.Struct, *array.Map:
+		value, err := arrowValueToJSON(arr, rowIdx, loc)
+		if err != nil {
+			return nil, err
+		}
+
+		jsonBytes, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		return string(jsonBytes), nil
 	default:
 		return nil, fmt.Errorf("unsupported arrow type: %T", arr)
 	}
 }
 
-func NewPostgreServer(logger *log.Logger) (*PostgreServer, error) {
+// arrowValueToJSON returns the value at the given row as a value that can be marshalled to JSON.
+// Structs and maps become objects and lists become arrays, recursing into nested values.
+func arrowValueToJSON(col arrow.Array, rowIdx int, loc *time.Location) (interface{}, error) {
+	if col.IsNull(rowIdx) {
+		return nil, nil
+	}
+
+	switch arr := col.(type) {
+	case *array.Struct:
+		structType := arr.DataType().(*arrow.StructType)
+		object := make(map[string]interface{}, arr.NumField())
+		for i := range arr.NumField() {
+			val, err := arrowValueToJSON(arr.Field(i), rowIdx, loc)
+			if err != nil {
+				return nil, err
+			}
+			object[structType.Field(i).Name] = val
+		}
+		return object, nil
+	case *array.Map:
+		start, end := arr.ValueOffsets(rowIdx)
+		object := make(map[string]interface{}, end-start)
+		for j := start; j < end; j++ {
+			key, err := arrowValueToInterface(arr.Keys(), int(j), loc)
+			if err != nil {
+				return nil, err
+			}
+			val, err := arrowValueToJSON(arr.Items(), int(j), loc)
+			if err != nil {
+				return nil, err
+			}
+			object[fmt.Sprint(key)] = val
+		}
+		return object, nil
+	case *array.Dictionary:
+		return arrowValueToJSON(arr.Dictionary(), arr.GetValueIndex(rowIdx), loc)
+	case *array.RunEndEncoded:
+		return arrowValueToJSON(arr.Values(), arr.GetPhysicalIndex(rowIdx), loc)
+	case array.ListLike:
+		start, end := arr.ValueOffsets(rowIdx)
+		values := make([]interface{}, 0, end-start)
+		for j := start; j < end; j++ {
+			val, err := arrowValueToJSON(arr.ListValues(), int(j), loc)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, val)
+		}
+		return values, nil
+	default:
+		return arrowValueToInterface(col, rowIdx, loc)
+	}
+}
+
+// formatInterval formats an interval as a PostgreSQL interval literal, e.g.
+// "0 years 0 mons 0 days 0 hours 0 mins 1.500000 secs".
+func formatInterval(months, days int32, d time.Duration) string {
+	hours := d / time.Hour
+	d -= hours * time.Hour
+	mins := d / time.Minute
+	d -= mins * time.Minute
+
+	return fmt.Sprintf("%d years %d mons %d days %d hours %d mins %.6f secs",
+		months/12, months%12, days, hours, mins, d.Seconds())
+}
+
+// formatDecimal formats the unscaled value of a decimal with the given scale as a numeric literal,
+// e.g. 123456 with scale 3 as "123.456".
+func formatDecimal(unscaled *big.Int, scale int32) string {
+	if scale <= 0 {
+		return new(big.Int).Mul(unscaled, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(-scale)), nil)).String()
+	}
+
+	digits := new(big.Int).Abs(unscaled).String()
+	if len(digits) <= int(scale) {
+		digits = strings.Repeat("0", int(scale)-len(digits)+1) + digits
+	}
+
+	sign := ""
+	if unscaled.Sign() < 0 {
+		sign = "-"
+	}
+
+	point := len(digits) - int(scale)
+	return sign + digits[:point] + "." + digits[point:]
+}
+
+func NewPostgreServer(logger *slog.Logger, cfg serverConfig) (*PostgreServer, error) {
 	server := &PostgreServer{
-		logger: logger,
+		logger:             logger,
+		baseURL:            cfg.BaseURL,
+		projectMap:         cfg.ProjectMap,
+		projectName:        cfg.ProjectName,
+		pgVersion:          cfg.PGVersion,
+		userAgent:          cfg.UserAgent,
+		retryPolicy:        cfg.RetryPolicy,
+		queryTimeout:       cfg.QueryTimeout,
+		maxRows:            cfg.MaxRows,
+		arrowBufferSize:    cfg.ArrowBufferSize,
+		maxResponseBytes:   cfg.MaxResponseBytes,
+		maxQuerySize:       cfg.MaxQuerySize,
+		slowQueryThreshold: cfg.SlowQueryThreshold,
+		httpClient:         newHTTPClient(cfg.MaxIdleConns, cfg.IdleConnTimeout),
+		dryRun:             cfg.DryRun,
+	}
+
+	if server.userAgent == "" {
+		server.userAgent = defaultUserAgent()
+	}
+
+	if server.pgVersion == "" {
+		server.pgVersion = defaultPGVersion
+	}
+	versionNum, err := pgVersionNum(server.pgVersion)
+	if err != nil {
+		return nil, err
+	}
+	server.pgVersionNum = versionNum
+
+	if cfg.AuditLogPath != "" {
+		auditLog, err := openAuditLog(cfg.AuditLogPath, cfg.AuditLogMaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		server.auditLog = auditLog
 	}
 
-	wireServer, err := wire.NewServer(
-		server.wireHandler,
-		wire.SessionAuthStrategy(wire.ClearTextPassword(server.auth)),
+	server.staticToken.Store(cfg.StaticToken)
+	server.columnCache = newColumnCache()
+
+	server.skipAuthValidation = cfg.AuthValidation == "none"
+	if cfg.AuthCacheTTL > 0 {
+		server.tokenCache = newTokenCache(cfg.AuthCacheTTL)
+	}
+
+	if cfg.MaxConnections > 0 {
+		server.connSlots = make(chan struct{}, cfg.MaxConnections)
+	}
+
+	// Validating tokens requires a request to Logfire, which a dry run never makes
+	authStrategy := wire.ClearTextPassword(server.auth)
+	if cfg.AuthMethod == "md5" {
+		authStrategy = server.md5Auth
+	}
+	if cfg.StaticToken != "" || cfg.DryRun {
+		authStrategy = trustAuth
+	}
+
+	options := []wire.OptionFn{
+		wire.SessionAuthStrategy(server.conns.identify(keepWriter(server.limitConnections(authStrategy)))),
 		wire.SessionMiddleware(server.session),
+		wire.Statements(newStatementCache),
 		wire.TerminateConn(server.terminateConn),
-		wire.Version("17.0"),
-	)
+		wire.Version(server.pgVersion),
+		wire.Logger(logger),
+		// Shutdown is bounded by the context passed to it instead
+		wire.WithShutdownTimeout(0),
+	}
+
+	if cfg.TLSConfig != nil {
+		options = append(options, wire.TLSConfig(cfg.TLSConfig))
+	}
+
+	if server.projectName != "" {
+		options = append(options, wire.GlobalParameters(wire.Parameters{wire.ParamApplicationName: server.projectName}))
+	}
+
+	wireServer, err := wire.NewServer(server.wireHandler, options...)
 	if err != nil {
 		return nil, err
 	}
@@ -244,65 +1235,591 @@ func NewPostgreServer(logger *log.Logger) (*PostgreServer, error) {
 	return server, nil
 }
 
+// Serve accepts client connections on the given listener until the server is shut down.
+func (s *PostgreServer) Serve(listener net.Listener) error {
+	return s.server.Serve(s.conns.listen(listener))
+}
+
+// Shutdown stops accepting new connections and waits for in-flight queries to finish until the given
+// context is done.
+func (s *PostgreServer) Shutdown(ctx context.Context) error {
+	s.shuttingDown.Store(true)
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		// Queries still streaming once the timeout is exceeded are aborted by closing their connections
+		s.conns.closeAll()
+	}
+	if s.auditLog != nil {
+		if closeErr := s.auditLog.Close(); closeErr != nil {
+			s.logger.Warn("failed to close audit log", "err", closeErr)
+		}
+	}
+	return err
+}
+
+// errTooManyConnections is returned to clients connecting while the connection limit is reached.
+var errTooManyConnections = psqlerr.WithSeverity(
+	psqlerr.WithCode(errors.New("sorry, too many clients already"), codes.TooManyConnections),
+	psqlerr.LevelFatal,
+)
+
+// limitConnections wraps the given auth strategy to reject clients once the maximum number of
+// connections is reached, before spending a request to the Logfire API on authenticating them. The
+// slot taken by a client is freed once its connection is closed.
+func (s *PostgreServer) limitConnections(next wire.AuthStrategy) wire.AuthStrategy {
+	return func(ctx context.Context, writer *buffer.Writer, reader *buffer.Reader) (context.Context, error) {
+		if s.connSlots == nil {
+			return next(ctx, writer, reader)
+		}
+
+		select {
+		case s.connSlots <- struct{}{}:
+		default:
+			s.logger.WarnContext(ctx, "rejecting connection, too many clients", "remote", wire.RemoteAddress(ctx).String())
+			if err := wire.ErrorCode(writer, errTooManyConnections); err != nil {
+				return ctx, err
+			}
+			return ctx, errTooManyConnections
+		}
+
+		release := func() { <-s.connSlots }
+		if !s.conns.onClose(ctx, release) {
+			// Without a tracked connection the slot could never be freed again
+			release()
+		}
+
+		return next(ctx, writer, reader)
+	}
+}
+
+// trustAuth accepts every client without asking for a password. It is used with a static --token,
+// which is used for all queries instead of a token sent by the client.
+func trustAuth(ctx context.Context, writer *buffer.Writer, reader *buffer.Reader) (context.Context, error) {
+	writer.Start(types.ServerAuth)
+	writer.AddInt32(0) // AuthenticationOk
+	return ctx, writer.End()
+}
+
+// md5Auth asks clients for an MD5 hashed password, which older clients such as libpq before version
+// 12 may send instead of a clear text one. As the hash cannot be reversed into a token, it is compared
+// to the hash of the token mapped to the database, which clients therefore have to use as password.
+func (s *PostgreServer) md5Auth(ctx context.Context, writer *buffer.Writer, reader *buffer.Reader) (context.Context, error) {
+	var salt [4]byte
+	if _, err := rand.Read(salt[:]); err != nil {
+		return ctx, err
+	}
+
+	writer.Start(types.ServerAuth)
+	writer.AddInt32(5) // AuthenticationMD5Password
+	writer.AddBytes(salt[:])
+	if err := writer.End(); err != nil {
+		return ctx, err
+	}
+
+	t, _, err := reader.ReadTypedMsg()
+	if err != nil {
+		return ctx, err
+	}
+	if t != types.ClientPassword {
+		return ctx, errors.New("unexpected password message")
+	}
+
+	hashed, err := reader.GetString()
+	if err != nil {
+		return ctx, err
+	}
+
+	params := wire.ClientParameters(ctx)
+	database, username := params[wire.ParamDatabase], params[wire.ParamUsername]
+	token, ok := s.projectMap[database]
+	valid := ok && subtle.ConstantTimeCompare([]byte(hashed), []byte(md5Password(token, username, salt))) == 1
+	if valid {
+		ctx, valid, err = s.auth(ctx, database, username, token)
+		if err != nil {
+			return ctx, err
+		}
+	}
+
+	if !valid {
+		s.logger.WarnContext(ctx, "md5 authentication failed", "database", database, "user", username)
+		authErr := psqlerr.WithCode(errors.New("invalid username/password"), codes.InvalidPassword)
+		if err := wire.ErrorCode(writer, authErr); err != nil {
+			return ctx, err
+		}
+		return ctx, authErr
+	}
+
+	writer.Start(types.ServerAuth)
+	writer.AddInt32(0) // AuthenticationOk
+	return ctx, writer.End()
+}
+
+// md5Password returns what a client sends as MD5 hashed password: "md5" followed by the hex encoded
+// md5(hex(md5(password + username)) + salt).
+func md5Password(password, username string, salt [4]byte) string {
+	inner := md5.Sum([]byte(password + username))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt[:]...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+// auth validates the password sent by the client as a Logfire read token. The token is forwarded to
+// the Logfire API on every query, so it has to be received in clear text: challenge-response methods
+// such as SCRAM-SHA-256 never reveal the password to the server. Use TLS to protect it in transit.
 func (s *PostgreServer) auth(ctx context.Context, database, username, password string) (context.Context, bool, error) {
 	if username == "" {
 		return ctx, false, fmt.Errorf("username cannot be empty")
 	}
 
-	// Validate password by making API call to logfire
-	respBody, err := executeQuery("SELECT 1", password)
-	if err != nil {
-		return ctx, false, fmt.Errorf("authentication failed: %w", err)
+	if token, ok := s.projectMap[database]; ok {
+		s.logger.InfoContext(ctx, "using mapped project token", "database", database)
+		password = token
+	}
+
+	if s.skipAuthValidation {
+		authenticationsTotal.WithLabelValues("skipped").Inc()
+	} else if s.tokenCache != nil && s.tokenCache.valid(password) {
+		authenticationsTotal.WithLabelValues("cached").Inc()
+	} else {
+		// Validate password by making API call to logfire. The Logfire API has no endpoint to only
+		// validate a token, so the query counts towards the project's query quota
+		respBody, err := s.executeQueryWithRetry(ctx, "SELECT 1", password)
+		authenticationsTotal.WithLabelValues(metricsStatus(err)).Inc()
+		if err != nil {
+			return ctx, false, fmt.Errorf("authentication failed: %w", err)
+		}
+		// Close immediately as we just need to verify the token works
+		respBody.Close()
+
+		if s.tokenCache != nil {
+			s.tokenCache.add(password)
+		}
 	}
-	// Close immediately as we just need to verify the token works
-	respBody.Close()
 
 	ctx = context.WithValue(ctx, readTokenCtxKey{}, password)
 
-	s.logger.Printf("successful authentication for user: %s", username)
+	s.logger.InfoContext(ctx, "successful authentication", "user", username)
 	return ctx, true, nil
 }
 
 // session middleware for handling session context
 func (s *PostgreServer) session(ctx context.Context) (context.Context, error) {
-	s.logger.Printf("new session established: %s", wire.RemoteAddress(ctx))
-	return ctx, nil
+	remote := wire.RemoteAddress(ctx).String()
+	appName := wire.ClientParameters(ctx)[wire.ParamApplicationName]
+	s.logger.InfoContext(ctx, "new session established", "remote", remote, "application_name", appName)
+	if token := s.staticToken.Load().(string); token != "" {
+		ctx = context.WithValue(ctx, readTokenCtxKey{}, token)
+	}
+
+	// The application name sent by the client, e.g. psql or a driver, is reported by SHOW and in logs
+	state := newSessionState()
+	if appName != "" {
+		state.defaults["application_name"] = appName
+	}
+	state.defaults["server_version"] = s.pgVersion
+	state.defaults["server_version_num"] = s.pgVersionNum
+
+	// The statistics are logged once the connection is closed, as TerminateConn is only called for
+	// clients sending a Terminate message
+	s.conns.onClose(ctx, func() {
+		s.logger.InfoContext(ctx, "session statistics", append([]any{"remote", remote, "application_name", appName}, state.stats.logAttrs()...)...)
+	})
+
+	// psql-wire never cancels the session context, cancel it once the connection is closed so that
+	// requests to Logfire still running for the session are aborted. Their contexts outlive the
+	// message that started them, so openQuery cancels them once state.closed is closed. The client
+	// disconnecting during a query is noticed by connTracker.watch.
+	ctx, cancel := context.WithCancel(ctx)
+	s.conns.onClose(ctx, cancel)
+	state.closed = ctx.Done()
+
+	return context.WithValue(ctx, sessionStateCtxKey{}, state), nil
 }
 
 // terminateConn handles connection termination
 func (s *PostgreServer) terminateConn(ctx context.Context) error {
-	s.logger.Printf("session terminated: %s", wire.RemoteAddress(ctx))
+	s.logger.InfoContext(ctx, "session terminated", "remote", wire.RemoteAddress(ctx).String(), "application_name", applicationName(ctx))
 	return nil
 }
 
+// queryFinished records a query forwarded to Logfire that was received at start and returned the
+// given number of rows, in the metrics, session statistics, slow query log and audit log. Queries
+// answered with empty results in dry-run mode are recorded as well, but not as forwarded.
+func (s *PostgreServer) queryFinished(ctx context.Context, query string, start time.Time, rows int, err error) {
+	duration := time.Since(start)
+	rowsReturnedTotal.Add(float64(rows))
+	recordQuery(start, err)
+	getSessionState(ctx).stats.record(rows, duration, err)
+
+	if s.slowQueryThreshold > 0 && duration > s.slowQueryThreshold {
+		s.logger.WarnContext(ctx, "slow query", "query", query, "duration", duration, "rows", rows, "remote", wire.RemoteAddress(ctx).String(), "application_name", applicationName(ctx))
+	}
+
+	s.audit(ctx, query, start, rows, !s.dryRun, err)
+}
+
+// audit appends a statement received at start to the audit log, if enabled. Statements answered or
+// rejected by logfire-pg itself are audited as not forwarded.
+func (s *PostgreServer) audit(ctx context.Context, query string, start time.Time, rows int, forwarded bool, err error) {
+	if s.auditLog == nil {
+		return
+	}
+
+	entry := auditEntry{
+		Timestamp:  start,
+		Remote:     wire.RemoteAddress(ctx).String(),
+		User:       wire.AuthenticatedUsername(ctx),
+		SQL:        query,
+		Forwarded:  forwarded,
+		Rows:       rows,
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	if err := s.auditLog.Write(entry); err != nil {
+		s.logger.WarnContext(ctx, "failed to write audit log", "err", err)
+	}
+}
+
+// errQueryTimeout is returned to the client when a query runs longer than the configured query timeout.
+var errQueryTimeout = psqlerr.WithSeverity(
+	psqlerr.WithCode(errors.New("canceling statement due to statement timeout"), codes.QueryCanceled),
+	psqlerr.LevelError,
+)
+
+// errResponseTooLarge is returned to the client when the response of the Logfire API to a query is
+// larger than the configured maximum response size.
+var errResponseTooLarge = psqlerr.WithSeverity(
+	psqlerr.WithCode(errors.New("canceling statement due to response size limit: the response of Logfire exceeds --max-response-bytes"), codes.ProgramLimitExceeded),
+	psqlerr.LevelError,
+)
+
+// clientQueryError returns the error reported to the client when a request to Logfire made with the given
+// context failed.
+func clientQueryError(ctx context.Context, err error) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return errQueryTimeout
+	}
+	if errors.Is(err, errResponseTooLarge) {
+		return errResponseTooLarge
+	}
+
+	var qErr *queryError
+	if errors.As(err, &qErr) {
+		return qErr.clientError()
+	}
+	return psqlerr.WithSeverity(psqlerr.WithCode(err, codes.SyntaxErrorOrAccessRuleViolation), psqlerr.LevelFatal)
+}
+
 // wireHandler processes incoming SQL queries
 func (s *PostgreServer) wireHandler(ctx context.Context, query string) (wire.PreparedStatements, error) {
-	s.logger.Printf("incoming SQL query: %s", query)
+	getSessionState(ctx).discardParsed = nil
+
+	// Oversized queries are rejected before they are logged, only their first --max-query-size bytes
+	// are audited
+	if s.maxQuerySize > 0 && len(query) > s.maxQuerySize {
+		s.logger.WarnContext(ctx, "rejected query exceeding the query size limit", "remote", wire.RemoteAddress(ctx).String(), "query_size", len(query), "max_query_size", s.maxQuerySize)
+		err := fmt.Errorf("query of %d bytes exceeds the maximum query size of %d bytes set by --max-query-size", len(query), s.maxQuerySize)
+		s.audit(ctx, strings.ToValidUTF8(query[:s.maxQuerySize], ""), time.Now(), 0, false, err)
+		return nil, psqlerr.WithSeverity(psqlerr.WithCode(err, codes.ProgramLimitExceeded), psqlerr.LevelError)
+	}
+
+	s.logger.InfoContext(ctx, "incoming SQL query", "remote", wire.RemoteAddress(ctx).String(), "application_name", applicationName(ctx), "query", query)
+
+	// Requests to Logfire made while handling the query are aborted if the client disconnects meanwhile
+	defer s.conns.watch(ctx)()
+
+	statements := splitStatements(query)
+	if len(statements) <= 1 {
+		return s.handleStatement(ctx, query)
+	}
+
+	// Clients such as ORMs prefix queries with session setup, e.g. "SET search_path=public; SELECT 1".
+	// The statements are run in order, only the last one may be forwarded to Logfire.
+	var result wire.PreparedStatements
+	for i, statement := range statements {
+		if i == len(statements)-1 {
+			stmts, err := s.handleStatement(ctx, statement)
+			if err != nil {
+				return nil, err
+			}
+			return append(result, stmts...), nil
+		}
+
+		start := time.Now()
+		stmts, ok := s.interceptQuery(ctx, statement)
+		if !ok {
+			err := fmt.Errorf("only the last statement of a multi-statement query can be run on Logfire: %s", statement)
+			s.audit(ctx, statement, start, 0, false, err)
+			return nil, psqlerr.WithSeverity(psqlerr.WithCode(err, codes.FeatureNotSupported), psqlerr.LevelError)
+		}
+		s.audit(ctx, statement, start, 0, false, nil)
+		result = append(result, stmts...)
+	}
+
+	return result, nil
+}
+
+// handleStatement processes a single SQL statement, answering it locally when possible and forwarding
+// it to Logfire otherwise.
+func (s *PostgreServer) handleStatement(ctx context.Context, query string) (_ wire.PreparedStatements, err error) {
+	ctx, span := startQuerySpan(ctx, query)
+	start := time.Now()
+
+	// The span of a query forwarded to Logfire is ended once its rows have been streamed by the
+	// returned statement
+	streaming := false
+	defer func() {
+		if !streaming {
+			endSpan(span, err)
+		}
+	}()
+
+	// Statements answered or rejected locally are audited here, the others by queryFinished
+	local := true
+	defer func() {
+		if local {
+			s.audit(ctx, query, start, 0, false, err)
+		}
+	}()
 
 	detectedCommand, suggestedQuery, isPsqlCommand := DetectPsqlCommandQuery(query)
 	if isPsqlCommand {
-		s.logger.Printf("detected psql command %s, suggesting alternative: %s", detectedCommand, suggestedQuery)
-		return nil, psqlerr.WithSeverity(
-			psqlerr.WithCode(
-				fmt.Errorf("psql commands are not supported. Detected trying to use: %s. Please run instead:\n\n%s", detectedCommand, suggestedQuery),
-				codes.FeatureNotSupported,
-			),
-			psqlerr.LevelError,
-		)
+		s.logger.InfoContext(ctx, "detected psql command", "command", detectedCommand, "suggestion", suggestedQuery)
+		err := fmt.Errorf("psql commands are not supported. Detected trying to use: %s. Please run instead:\n\n%s", detectedCommand, suggestedQuery)
+		// Commands are given with their arguments, e.g. \d records
+		command, _, _ := strings.Cut(detectedCommand, " ")
+		if hint, ok := psqlCommandHints[command]; ok {
+			err = psqlerr.WithHint(err, hint)
+		}
+		return nil, psqlerr.WithSeverity(psqlerr.WithCode(err, codes.FeatureNotSupported), psqlerr.LevelError)
+	}
+
+	if detectedCommand, ok := detectUnsupportedPsqlCommand(query); ok {
+		s.logger.InfoContext(ctx, "detected unsupported psql command", "command", detectedCommand)
+		err := fmt.Errorf("This psql command is not supported. Detected trying to use: %s", detectedCommand)
+		if hint, ok := psqlCommandHints[detectedCommand]; ok {
+			err = psqlerr.WithHint(err, hint)
+		}
+		return nil, psqlerr.WithSeverity(psqlerr.WithCode(err, codes.FeatureNotSupported), psqlerr.LevelError)
+	}
+
+	// The COPY sub-protocol is not implemented, clients would wait for a CopyInResponse or
+	// CopyOutResponse forever
+	if firstKeyword(query) == "COPY" || strings.HasPrefix(strings.TrimSpace(query), `\copy`) {
+		err := errors.New("COPY is not supported; use SELECT to read data from Logfire.")
+		return nil, psqlerr.WithSeverity(psqlerr.WithCode(err, codes.FeatureNotSupported), psqlerr.LevelError)
+	}
+
+	if stmts, ok := s.interceptQuery(ctx, query); ok {
+		return stmts, nil
+	}
+
+	// Successful queries are recorded once their rows have been streamed by the returned statement
+	local = false
+	defer func() {
+		if err != nil {
+			s.queryFinished(ctx, query, start, 0, err)
+		}
+	}()
+
+	if s.dryRun {
+		s.logger.InfoContext(ctx, "dry run, not forwarding query to Logfire", "query", query)
+		s.queryFinished(ctx, query, start, 0, nil)
+		return dryRunResult(query), nil
+	}
+
+	if opts, statement, ok := parseExplain(query); ok {
+		stmts, rows, err := s.explainResult(ctx, opts, statement)
+		if err == nil {
+			s.queryFinished(ctx, query, start, rows, nil)
+		}
+		return stmts, err
+	}
+
+	// Queries with parameters are sent using the extended query protocol, their values are only bound
+	// once the statement is executed. The result columns are looked up by a preflight query instead,
+	// once for every statement text as long as they don't change.
+	parameters := queryParameters(query)
+	if parameters > 0 {
+		readToken := ctx.Value(readTokenCtxKey{}).(string)
+		columns, ok := s.columnCache.get(readToken, query)
+		if !ok {
+			result, err := s.openQuery(ctx, preflightQuery(query))
+			if err != nil {
+				return nil, err
+			}
+			result.close()
+			columns = result.columns
+			s.columnCache.add(readToken, query, columns)
+		}
+
+		var prefetched atomic.Pointer[queryResult]
+		handle := func(ctx context.Context, writer wire.DataWriter, params []wire.Parameter) error {
+			return s.executeStatement(ctx, writer, query, columns, params, &prefetched)
+		}
+
+		return wire.Prepared(wire.NewStatement(handle, wire.WithParameters(textParameterTypes(parameters)), wire.WithColumns(columns))), nil
+	}
+
+	result, err := s.openQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	result.span, result.start = span, start
+
+	// The result is streamed by the first execution of the statement, a prepared statement executed
+	// again runs the query again
+	var prefetched atomic.Pointer[queryResult]
+	prefetched.Store(result)
+	handle := func(ctx context.Context, writer wire.DataWriter, params []wire.Parameter) error {
+		return s.executeStatement(ctx, writer, query, result.columns, params, &prefetched)
+	}
+
+	// The result of a statement that is never executed is discarded by statementCache
+	getSessionState(ctx).discardParsed = func() {
+		if result := prefetched.Swap(nil); result != nil {
+			s.logger.DebugContext(ctx, "discarding result of statement that was never executed", "query", query)
+			result.close()
+			s.queryFinished(ctx, query, result.start, 0, nil)
+			endSpan(result.span, nil)
+		}
+	}
+
+	streaming = true
+	return wire.Prepared(wire.NewStatement(handle, wire.WithColumns(result.columns))), nil
+}
+
+// dryRunResult returns a statement producing no columns and no rows for the given query, accepting
+// the parameters it references.
+func dryRunResult(query string) wire.PreparedStatements {
+	handle := func(ctx context.Context, writer wire.DataWriter, params []wire.Parameter) error {
+		return writer.Complete(commandTag(query, 0))
+	}
+
+	return wire.Prepared(wire.NewStatement(handle, wire.WithParameters(textParameterTypes(queryParameters(query)))))
+}
+
+// startQuerySpan starts the span tracing the given query.
+func startQuerySpan(ctx context.Context, query string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "logfire_pg.query", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("db.statement", query),
+		attribute.String("db.system", "postgresql"),
+		attribute.String("net.peer.name", wire.RemoteAddress(ctx).String()),
+		attribute.String("logfire.project", wire.AuthenticatedUsername(ctx)),
+	))
+}
+
+// queryResult is the response of the Logfire API to a query, whose rows have yet to be read.
+type queryResult struct {
+	query   string
+	body    io.ReadCloser
+	reader  *ipc.Reader
+	columns wire.Columns
+	// ctx bounds the request, and is cancelled by close.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// span and start are those of the query the result is streamed for.
+	span  trace.Span
+	start time.Time
+	// readErr is the error that ended readRecords, set once its channel is closed. readDone is closed
+	// once readRecords no longer uses the reader.
+	readErr  error
+	readDone chan struct{}
+}
+
+// readRecords reads the record batches of the result in a separate goroutine and sends them on the
+// returned channel, which is closed once the result has been read or the request is cancelled. Every
+// record received must be released.
+func (r *queryResult) readRecords() <-chan arrow.Record {
+	records := make(chan arrow.Record)
+	r.readDone = make(chan struct{})
+
+	go func() {
+		defer close(r.readDone)
+		defer close(records)
+
+		for r.reader.Next() {
+			// The reader reuses the record once Next is called again
+			record := r.reader.Record()
+			record.Retain()
+
+			select {
+			case records <- record:
+			case <-r.ctx.Done():
+				record.Release()
+				return
+			}
+		}
+		r.readErr = r.reader.Err()
+	}()
+
+	return records
+}
+
+func (r *queryResult) close() {
+	r.cancel()
+	r.body.Close()
+	if r.readDone != nil {
+		// Closing the body interrupts a pending read, after which the reader is no longer in use
+		<-r.readDone
+	}
+	r.reader.Release()
+}
+
+// openQuery forwards the given query to Logfire and returns its result, or the error to report to the
+// client.
+func (s *PostgreServer) openQuery(ctx context.Context, query string) (*queryResult, error) {
+	// The returned result may be read by a later Execute message (extended query protocol), after the
+	// context of this Parse message has been cancelled. The request is therefore bound to the lifetime
+	// of the result instead and cancelled once it is closed, times out or the connection is closed.
+	var queryCtx context.Context
+	var cancel context.CancelFunc
+	if s.queryTimeout > 0 {
+		queryCtx, cancel = context.WithTimeout(context.WithoutCancel(ctx), s.queryTimeout)
+	} else {
+		queryCtx, cancel = context.WithCancel(context.WithoutCancel(ctx))
+	}
+	if closed := getSessionState(ctx).closed; closed != nil {
+		go func() {
+			select {
+			case <-closed:
+				cancel()
+			case <-queryCtx.Done():
+			}
+		}()
+	}
+
+	// Queries reading the information_schema are rewritten once their parameters have been bound,
+	// which may name the table whose columns are looked up
+	sql, err := s.rewriteCatalogQuery(ctx, query)
+	if err != nil {
+		cancel()
+		return nil, err
 	}
 
 	readToken := ctx.Value(readTokenCtxKey{}).(string)
-	respBody, err := executeQuery(query, readToken)
+	respBody, err := s.executeQueryWithRetry(queryCtx, sql, readToken)
 	if err != nil {
-		s.logger.Printf("query execution error: %v", err)
-		return nil, psqlerr.WithSeverity(psqlerr.WithCode(err, codes.SyntaxErrorOrAccessRuleViolation), psqlerr.LevelFatal)
+		cancel()
+		s.logger.WarnContext(ctx, "query execution error", "query", query, "err", err)
+		return nil, clientQueryError(queryCtx, err)
 	}
 
 	// Create Arrow IPC reader from the response stream
-	reader, err := ipc.NewReader(respBody)
+	var stream io.Reader = respBody
+	if s.arrowBufferSize > 0 {
+		stream = bufio.NewReaderSize(respBody, s.arrowBufferSize)
+	}
+	reader, err := ipc.NewReader(stream)
 	if err != nil {
 		respBody.Close()
-		s.logger.Printf("failed to create arrow reader: %v", err)
+		cancel()
+		s.logger.WarnContext(ctx, "failed to create arrow reader", "query", query, "err", err)
+		if errors.Is(err, errResponseTooLarge) {
+			return nil, errResponseTooLarge
+		}
 		return nil, psqlerr.WithSeverity(psqlerr.WithCode(err, codes.DataException), psqlerr.LevelFatal)
 	}
 
@@ -310,11 +1827,17 @@ func (s *PostgreServer) wireHandler(ctx context.Context, query string) (wire.Pre
 	schema := reader.Schema()
 	var columns wire.Columns
 	for _, field := range schema.Fields() {
-		pgOid, err := arrowTypeToPgOid(field.Type)
+		// PostgreSQL has no place for arbitrary column metadata, such as the units of a column
+		if field.HasMetadata() {
+			s.logger.DebugContext(ctx, "column metadata", "column", field.Name, "metadata", metadataAttrs(field.Metadata))
+		}
+
+		pgOid, err := arrowFieldToPgOid(field)
 		if err != nil {
 			reader.Release()
 			respBody.Close()
-			s.logger.Printf("type mapping error for column %s: %v", field.Name, err)
+			cancel()
+			s.logger.WarnContext(ctx, "type mapping error", "query", query, "column", field.Name, "err", err)
 			return nil, psqlerr.WithSeverity(psqlerr.WithCode(err, codes.DatatypeMismatch), psqlerr.LevelFatal)
 		}
 
@@ -326,44 +1849,149 @@ func (s *PostgreServer) wireHandler(ctx context.Context, query string) (wire.Pre
 		})
 	}
 
-	// Build the handler that streams rows from Arrow batches
-	handle := func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
-		defer reader.Release()
-		defer respBody.Close()
+	return &queryResult{
+		query:   query,
+		body:    respBody,
+		reader:  reader,
+		columns: columns,
+		ctx:     queryCtx,
+		cancel:  cancel,
+	}, nil
+}
+
+// executeStatement streams the rows of a statement forwarded to Logfire to the client. The statement
+// is run with the given parameters, unless a result fetched when it was parsed is still available.
+// Its result must have the given columns, which were described to the client when it was parsed.
+func (s *PostgreServer) executeStatement(ctx context.Context, writer wire.DataWriter, query string, columns wire.Columns, params []wire.Parameter, prefetched *atomic.Pointer[queryResult]) (err error) {
+	defer s.conns.watch(ctx)()
 
-		totalRows := 0
+	result := prefetched.Swap(nil)
+	if result == nil {
+		sql, err := substituteParams(query, params)
+		if err != nil {
+			return psqlerr.WithSeverity(psqlerr.WithCode(err, codes.InvalidParameterValue), psqlerr.LevelError)
+		}
 
-		// Stream through all record batches
-		for reader.Next() {
-			record := reader.Record()
-			numRows := int(record.NumRows())
-			numCols := int(record.NumCols())
+		ctx, span := startQuerySpan(ctx, sql)
+		start := time.Now()
+		result, err = s.openQuery(ctx, sql)
+		if err == nil && !sameColumnTypes(result.columns, columns) {
+			// The statement is described again by the preflight query once the client prepares it again
+			result.close()
+			s.columnCache.remove(ctx.Value(readTokenCtxKey{}).(string), query)
+			err = psqlerr.WithSeverity(psqlerr.WithCode(errors.New("cached plan must not change result type"), codes.FeatureNotSupported), psqlerr.LevelError)
+		}
+		if err != nil {
+			s.queryFinished(ctx, sql, start, 0, err)
+			endSpan(span, err)
+			return err
+		}
+		result.span, result.start = span, start
+	}
+	defer result.close()
 
-			// Process each row in the batch
-			for i := range numRows {
-				row := make([]any, numCols)
+	totalRows := 0
+	defer func() {
+		s.queryFinished(ctx, result.query, result.start, totalRows, err)
+		result.span.SetAttributes(attribute.Int("db.rows_returned", totalRows))
+		endSpan(result.span, err)
+	}()
 
-				// Extract values for each column
-				for j := range numCols {
-					col := record.Column(j)
-					val, err := arrowValueToInterface(col, i)
-					if err != nil {
-						return fmt.Errorf("failed to convert column %d row %d: %w", j, i, err)
-					}
-					row[j] = val
+	// writer.Row encodes the values right away, so a single row is reused for every row of the result
+	row := make([]any, len(result.columns))
+	loc := getSessionState(ctx).location()
+
+	// writeRecord writes the rows of a record batch to the client
+	writeRecord := func(record arrow.Record) error {
+		numRows := int(record.NumRows())
+		numCols := int(record.NumCols())
+		s.logger.DebugContext(ctx, "streaming record batch", "rows", numRows, "columns", numCols)
+
+		// Process each row in the batch
+		for i := range numRows {
+			if s.maxRows > 0 && totalRows >= s.maxRows {
+				s.logger.WarnContext(ctx, "query canceled after exceeding the row limit", "query", result.query, "max_rows", s.maxRows)
+				err := fmt.Errorf("canceling statement due to row limit: query returned more than %d rows", s.maxRows)
+				return psqlerr.WithSeverity(psqlerr.WithCode(err, codes.QueryCanceled), psqlerr.LevelError)
+			}
+
+			row = row[:numCols]
+
+			// Extract values for each column
+			for j := range numCols {
+				col := record.Column(j)
+				val, err := arrowValueToInterface(col, i, loc)
+				if err != nil {
+					return fmt.Errorf("failed to convert column %d row %d: %w", j, i, err)
 				}
+				row[j] = val
+			}
 
-				writer.Row(row)
-				totalRows++
+			// writer.Row writes the row to the connection right away, so a failed write means the
+			// client has gone away. Returning closes the response body, which stops the download of
+			// the rest of the result from Logfire.
+			if err := writer.Row(row); err != nil {
+				s.logger.WarnContext(ctx, "client disconnected, aborting query", "query", result.query, "rows", totalRows, "err", err)
+				return err
+			}
+			totalRows++
+
+			if err := ctx.Err(); err != nil {
+				s.logger.WarnContext(ctx, "session closed, aborting query", "query", result.query, "rows", totalRows, "err", err)
+				return err
 			}
 		}
+		return nil
+	}
 
-		if err := reader.Err(); err != nil {
-			return fmt.Errorf("error reading arrow stream: %w", err)
+	// Stream through all record batches. They are read in the background, so that waiting for Logfire
+	// to send the next one is interrupted as well once the session is closed.
+	records := result.readRecords()
+	for {
+		var record arrow.Record
+		var ok bool
+		select {
+		case record, ok = <-records:
+		case <-ctx.Done():
+			s.logger.WarnContext(ctx, "session closed, aborting query", "query", result.query, "rows", totalRows, "err", ctx.Err())
+			return ctx.Err()
 		}
+		if !ok {
+			break
+		}
+
+		err := writeRecord(record)
+		record.Release()
+		if err != nil {
+			return err
+		}
+	}
 
-		return writer.Complete(fmt.Sprintf("SELECT %d", totalRows))
+	// Reading stops without an error when the request is cancelled while a batch is being handed over
+	if result.ctx.Err() == context.DeadlineExceeded {
+		return errQueryTimeout
 	}
+	if err := result.readErr; err != nil {
+		if errors.Is(err, errResponseTooLarge) {
+			s.logger.WarnContext(ctx, "query canceled after exceeding the response size limit", "query", result.query, "max_response_bytes", s.maxResponseBytes)
+			return errResponseTooLarge
+		}
+		return fmt.Errorf("error reading arrow stream: %w", err)
+	}
+
+	s.logger.InfoContext(ctx, "query completed", "query", result.query, "rows", totalRows, "duration", time.Since(result.start))
+	return writer.Complete(commandTag(result.query, totalRows))
+}
 
-	return wire.Prepared(wire.NewStatement(handle, wire.WithColumns(columns))), nil
+// sameColumnTypes reports whether both sets of columns have the same types.
+func sameColumnTypes(a, b wire.Columns) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Oid != b[i].Oid {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,1184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v18/arrow"
+	"github.com/apache/arrow/go/v18/arrow/array"
+	"github.com/apache/arrow/go/v18/arrow/decimal128"
+	"github.com/apache/arrow/go/v18/arrow/float16"
+	"github.com/apache/arrow/go/v18/arrow/ipc"
+	"github.com/apache/arrow/go/v18/arrow/memory"
+	"github.com/lib/pq"
+	"github.com/lib/pq/oid"
+)
+
+// testToken is the static read token the servers of the tests are started with.
+const testToken = "pylf_v1_us_test"
+
+// fakeLogfire is a Logfire API answering every query with the record returned by respond, recording
+// the queries it received.
+type fakeLogfire struct {
+	*httptest.Server
+	mu      sync.Mutex
+	queries []string
+}
+
+func newFakeLogfire(t *testing.T, respond func(sql string) arrow.Record) *fakeLogfire {
+	t.Helper()
+	f := &fakeLogfire{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+testToken {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		query := r.URL.Query().Get("sql")
+		f.mu.Lock()
+		f.queries = append(f.queries, query)
+		f.mu.Unlock()
+
+		record := respond(query)
+		defer record.Release()
+		w.Header().Set("Content-Type", "application/vnd.apache.arrow.stream")
+		writer := ipc.NewWriter(w, ipc.WithSchema(record.Schema()))
+		if err := writer.Write(record); err != nil {
+			t.Errorf("failed to write record: %v", err)
+		}
+		writer.Close()
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// received returns the queries received so far.
+func (f *fakeLogfire) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.queries)
+}
+
+// int64Record returns a record with a single int64 column of the given name and values.
+func int64Record(name string, values ...int64) arrow.Record {
+	schema := arrow.NewSchema([]arrow.Field{{Name: name, Type: arrow.PrimitiveTypes.Int64}}, nil)
+	builder := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	defer builder.Release()
+	builder.Field(0).(*array.Int64Builder).AppendValues(values, nil)
+	return builder.NewRecord()
+}
+
+// startTestServer starts a server querying the given Logfire API with testToken on an ephemeral port,
+// shut down at the end of the test, and returns the connection string of its logfire database.
+func startTestServer(t *testing.T, baseURL string, cfg serverConfig) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	return serveTestServer(t, listener, baseURL, cfg)
+}
+
+// serveTestServer is startTestServer for a server accepting connections on the given listener.
+func serveTestServer(t *testing.T, listener net.Listener, baseURL string, cfg serverConfig) string {
+	t.Helper()
+	cfg.BaseURL = baseURL
+	cfg.StaticToken = testToken
+
+	server, err := NewPostgreServer(slog.New(slog.NewTextHandler(io.Discard, nil)), cfg)
+	if err != nil {
+		listener.Close()
+		t.Fatalf("failed to create server: %v", err)
+	}
+	go server.Serve(listener)
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+	return fmt.Sprintf("postgres://user@%s/logfire?sslmode=disable", listener.Addr())
+}
+
+// openTestDB returns a database handle for the given connection string, closed at the end of the test.
+func openTestDB(t *testing.T, dsn string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestFullRoundTrip(t *testing.T) {
+	logfire := newFakeLogfire(t, func(sql string) arrow.Record {
+		return int64Record("?column?", 1)
+	})
+	db := openTestDB(t, startTestServer(t, logfire.URL, serverConfig{}))
+
+	var n int64
+	if err := db.QueryRow("SELECT 1").Scan(&n); err != nil {
+		t.Fatalf("SELECT 1 failed: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("SELECT 1 returned %d, want 1", n)
+	}
+
+	if got, want := logfire.received(), []string{"SELECT 1"}; !slices.Equal(got, want) {
+		t.Errorf("Logfire received %q, want %q", got, want)
+	}
+}
+
+func TestPreparedStatement(t *testing.T) {
+	logfire := newFakeLogfire(t, func(sql string) arrow.Record {
+		if strings.HasSuffix(sql, "LIMIT 0") {
+			return int64Record("n")
+		}
+		return int64Record("n", 42)
+	})
+	db := openTestDB(t, startTestServer(t, logfire.URL, serverConfig{}))
+
+	// lib/pq sends queries with arguments as Parse, Bind and Execute messages
+	const query = "SELECT n FROM records WHERE message = $1"
+	for _, message := range []string{"it's", "123"} {
+		var n int64
+		if err := db.QueryRow(query, message).Scan(&n); err != nil {
+			t.Fatalf("query with %q failed: %v", message, err)
+		}
+		if n != 42 {
+			t.Errorf("query with %q returned %d, want 42", message, n)
+		}
+	}
+
+	// The columns are looked up by a single preflight query for both executions
+	want := []string{
+		"SELECT * FROM (\nSELECT n FROM records WHERE message = NULL\n) AS preflight LIMIT 0",
+		"SELECT n FROM records WHERE message = 'it''s'",
+		"SELECT n FROM records WHERE message = 123",
+	}
+	if got := logfire.received(); !slices.Equal(got, want) {
+		t.Errorf("Logfire received %q, want %q", got, want)
+	}
+}
+
+func TestExecuteQueryCancel(t *testing.T) {
+	started := make(chan struct{})
+	aborted := make(chan struct{})
+	logfire := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			close(aborted)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer logfire.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	_, err := executeQuery(ctx, newHTTPClient(1, time.Minute), logfire.URL, "test", "SELECT 1", testToken)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("executeQuery returned %v, want context.Canceled", err)
+	}
+
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request to Logfire was not aborted")
+	}
+}
+
+// connDialer is a pq.Dialer keeping the connection it dialed, so that tests can drop it.
+type connDialer struct {
+	conn net.Conn
+}
+
+func (d *connDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialTimeout(network, address, 0)
+}
+
+func (d *connDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout(network, address, timeout)
+	d.conn = conn
+	return conn, err
+}
+
+func TestClientDisconnectAbortsQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query func(conn driver.Conn) error
+	}{
+		{
+			name: "simple query",
+			query: func(conn driver.Conn) error {
+				_, err := conn.(driver.QueryerContext).QueryContext(context.Background(), "SELECT slow", nil)
+				return err
+			},
+		},
+		{
+			// Statements without parameters are run when they are parsed
+			name: "extended query",
+			query: func(conn driver.Conn) error {
+				_, err := conn.Prepare("SELECT slow")
+				return err
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started := make(chan struct{})
+			aborted := make(chan struct{})
+			logfire := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				select {
+				case <-r.Context().Done():
+					close(aborted)
+				case <-time.After(10 * time.Second):
+				}
+			}))
+			defer logfire.Close()
+
+			// Without a query timeout, only the client disconnecting ends the request
+			dsn := startTestServer(t, logfire.URL, serverConfig{})
+			dialer := &connDialer{}
+			conn, err := pq.DialOpen(dialer, dsn)
+			if err != nil {
+				t.Fatalf("failed to connect: %v", err)
+			}
+			defer conn.Close()
+
+			go func() {
+				<-started
+				dialer.conn.Close()
+			}()
+			if err := tt.query(conn); err == nil {
+				t.Fatal("query succeeded after the connection was closed")
+			}
+
+			select {
+			case <-aborted:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the request to Logfire was not aborted")
+			}
+		})
+	}
+}
+
+// pgMessage returns a frontend message of the given type with the given body.
+func pgMessage(typ byte, body []byte) []byte {
+	msg := binary.BigEndian.AppendUint32([]byte{typ}, uint32(len(body)+4))
+	return append(msg, body...)
+}
+
+// parseMessage returns a Parse message for the given statement, declaring no parameter types.
+func parseMessage(name, query string) []byte {
+	return pgMessage('P', append([]byte(name+"\x00"+query+"\x00"), 0, 0))
+}
+
+// dialTestServer connects to the test server with the given connection string using the protocol
+// directly, for tests sending messages lib/pq doesn't.
+func dialTestServer(t *testing.T, dsn string) net.Conn {
+	t.Helper()
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatalf("invalid connection string: %v", err)
+	}
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	startup := binary.BigEndian.AppendUint32(make([]byte, 4), 3<<16)
+	startup = append(startup, "user\x00user\x00database\x00logfire\x00\x00"...)
+	binary.BigEndian.PutUint32(startup, uint32(len(startup)))
+	if _, err := conn.Write(startup); err != nil {
+		t.Fatalf("failed to send startup message: %v", err)
+	}
+	readUntilReady(t, conn)
+	return conn
+}
+
+// readUntilReady reads the backend messages up to the next ReadyForQuery and returns their types.
+func readUntilReady(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	var types []byte
+	header := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			t.Fatalf("failed to read message: %v", err)
+		}
+		if _, err := io.CopyN(io.Discard, conn, int64(binary.BigEndian.Uint32(header[1:]))-4); err != nil {
+			t.Fatalf("failed to read message: %v", err)
+		}
+		types = append(types, header[0])
+		if header[0] == 'Z' {
+			return string(types)
+		}
+	}
+}
+
+func TestUnexecutedStatementDiscarded(t *testing.T) {
+	tests := []struct {
+		name string
+		// then is sent once the statement has been parsed, followed by Sync if wantReply is set.
+		then      []byte
+		wantReply string
+	}{
+		{
+			name:      "statement replaced",
+			then:      parseMessage("", "SELECT 1"),
+			wantReply: "1Z",
+		},
+		{
+			name: "connection closed",
+			then: pgMessage('X', nil),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aborted := make(chan struct{})
+			logfire := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				record := int64Record("n", 1)
+				defer record.Release()
+				writer := ipc.NewWriter(w, ipc.WithSchema(record.Schema()))
+				writer.Write(record)
+				if r.URL.Query().Get("sql") != "SELECT slow" {
+					writer.Close()
+					return
+				}
+
+				// The response is left open, as if Logfire was still sending the result
+				w.(http.Flusher).Flush()
+				select {
+				case <-r.Context().Done():
+					close(aborted)
+				case <-time.After(10 * time.Second):
+				}
+			}))
+			defer logfire.Close()
+
+			// Without a query timeout, the request only ends once the result is discarded
+			conn := dialTestServer(t, startTestServer(t, logfire.URL, serverConfig{}))
+
+			// A statement without parameters is run when it is parsed
+			if _, err := conn.Write(append(parseMessage("", "SELECT slow"), pgMessage('S', nil)...)); err != nil {
+				t.Fatalf("failed to send Parse: %v", err)
+			}
+			if got := readUntilReady(t, conn); got != "1Z" {
+				t.Fatalf("Parse returned messages %q, want %q", got, "1Z")
+			}
+
+			then := tt.then
+			if tt.wantReply != "" {
+				then = append(then, pgMessage('S', nil)...)
+			}
+			if _, err := conn.Write(then); err != nil {
+				t.Fatalf("failed to send message: %v", err)
+			}
+			if tt.wantReply != "" {
+				if got := readUntilReady(t, conn); got != tt.wantReply {
+					t.Fatalf("received messages %q, want %q", got, tt.wantReply)
+				}
+			}
+
+			select {
+			case <-aborted:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the request to Logfire of the unexecuted statement was not aborted")
+			}
+		})
+	}
+}
+
+func TestArrowValueToInterfaceStruct(t *testing.T) {
+	serviceType := arrow.StructOf(
+		arrow.Field{Name: "name", Type: arrow.BinaryTypes.String, Nullable: true},
+		arrow.Field{Name: "version", Type: arrow.PrimitiveTypes.Int64, Nullable: true},
+	)
+	recordType := arrow.StructOf(
+		arrow.Field{Name: "level", Type: arrow.PrimitiveTypes.Int32, Nullable: true},
+		arrow.Field{Name: "service", Type: serviceType, Nullable: true},
+	)
+
+	builder := array.NewStructBuilder(memory.DefaultAllocator, recordType)
+	defer builder.Release()
+	service := builder.FieldBuilder(1).(*array.StructBuilder)
+
+	builder.Append(true)
+	builder.FieldBuilder(0).(*array.Int32Builder).Append(9)
+	service.Append(true)
+	service.FieldBuilder(0).(*array.StringBuilder).Append("api")
+	service.FieldBuilder(1).(*array.Int64Builder).Append(2)
+
+	builder.Append(true)
+	builder.FieldBuilder(0).(*array.Int32Builder).AppendNull()
+	service.AppendNull()
+	service.FieldBuilder(0).(*array.StringBuilder).AppendNull()
+	service.FieldBuilder(1).(*array.Int64Builder).AppendNull()
+
+	builder.AppendNull()
+	builder.FieldBuilder(0).(*array.Int32Builder).AppendNull()
+	service.AppendNull()
+	service.FieldBuilder(0).(*array.StringBuilder).AppendNull()
+	service.FieldBuilder(1).(*array.Int64Builder).AppendNull()
+
+	arr := builder.NewArray()
+	defer arr.Release()
+
+	if got, err := arrowTypeToPgOid(recordType); err != nil || got != oid.T_jsonb {
+		t.Errorf("arrowTypeToPgOid(struct) = %v, %v, want %v", got, err, oid.T_jsonb)
+	}
+
+	want := []any{
+		`{"level":9,"service":{"name":"api","version":2}}`,
+		`{"level":null,"service":null}`,
+		nil,
+	}
+	for i, want := range want {
+		got, err := arrowValueToInterface(arr, i, time.UTC)
+		if err != nil {
+			t.Fatalf("arrowValueToInterface(struct, %d) returned error: %v", i, err)
+		}
+		if got != want {
+			t.Errorf("arrowValueToInterface(struct, %d) = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestArrowValueToInterface(t *testing.T) {
+	mem := memory.DefaultAllocator
+	newArray := func(dt arrow.DataType, appendValue func(array.Builder)) arrow.Array {
+		builder := array.NewBuilder(mem, dt)
+		defer builder.Release()
+		appendValue(builder)
+		return builder.NewArray()
+	}
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf("failed to load time zone: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		dt      arrow.DataType
+		append  func(array.Builder)
+		loc     *time.Location
+		wantOid oid.Oid
+		want    any
+	}{
+		{
+			name:    "string",
+			dt:      arrow.BinaryTypes.String,
+			append:  func(b array.Builder) { b.(*array.StringBuilder).Append("hello") },
+			wantOid: oid.T_text,
+			want:    "hello",
+		},
+		{
+			name:    "bool",
+			dt:      arrow.FixedWidthTypes.Boolean,
+			append:  func(b array.Builder) { b.(*array.BooleanBuilder).Append(true) },
+			wantOid: oid.T_bool,
+			want:    true,
+		},
+		{
+			name:    "int32",
+			dt:      arrow.PrimitiveTypes.Int32,
+			append:  func(b array.Builder) { b.(*array.Int32Builder).Append(math.MinInt32) },
+			wantOid: oid.T_int4,
+			want:    float64(math.MinInt32),
+		},
+		{
+			name:    "int64",
+			dt:      arrow.PrimitiveTypes.Int64,
+			append:  func(b array.Builder) { b.(*array.Int64Builder).Append(1 << 40) },
+			wantOid: oid.T_int8,
+			want:    float64(1 << 40),
+		},
+		{
+			name:    "uint32",
+			dt:      arrow.PrimitiveTypes.Uint32,
+			append:  func(b array.Builder) { b.(*array.Uint32Builder).Append(math.MaxUint32) },
+			wantOid: oid.T_int8,
+			want:    float64(math.MaxUint32),
+		},
+		{
+			name:    "uint64 max",
+			dt:      arrow.PrimitiveTypes.Uint64,
+			append:  func(b array.Builder) { b.(*array.Uint64Builder).Append(math.MaxUint64) },
+			wantOid: oid.T_numeric,
+			want:    "18446744073709551615",
+		},
+		{
+			name:    "float64",
+			dt:      arrow.PrimitiveTypes.Float64,
+			append:  func(b array.Builder) { b.(*array.Float64Builder).Append(1.5) },
+			wantOid: oid.T_float8,
+			want:    1.5,
+		},
+		{
+			name:    "float32",
+			dt:      arrow.PrimitiveTypes.Float32,
+			append:  func(b array.Builder) { b.(*array.Float32Builder).Append(-0.25) },
+			wantOid: oid.T_float4,
+			want:    -0.25,
+		},
+		{
+			name:    "float16",
+			dt:      arrow.FixedWidthTypes.Float16,
+			append:  func(b array.Builder) { b.(*array.Float16Builder).Append(float16.New(2.5)) },
+			wantOid: oid.T_float4,
+			want:    2.5,
+		},
+		{
+			name: "list of float32",
+			dt:   arrow.ListOf(arrow.PrimitiveTypes.Float32),
+			append: func(b array.Builder) {
+				list := b.(*array.ListBuilder)
+				list.Append(true)
+				list.ValueBuilder().(*array.Float32Builder).AppendValues([]float32{1.5, -0.25}, nil)
+			},
+			wantOid: oid.T__float4,
+			want:    "[1.5,-0.25]",
+		},
+		{
+			name:    "date32",
+			dt:      arrow.FixedWidthTypes.Date32,
+			append:  func(b array.Builder) { b.(*array.Date32Builder).Append(arrow.Date32(19723)) },
+			wantOid: oid.T_date,
+			want:    "2024-01-01",
+		},
+		{
+			name: "timestamp",
+			dt:   &arrow.TimestampType{Unit: arrow.Microsecond, TimeZone: "UTC"},
+			append: func(b array.Builder) {
+				b.(*array.TimestampBuilder).Append(arrow.Timestamp(time.Date(2024, 1, 1, 12, 0, 0, 500, time.UTC).UnixMicro()))
+			},
+			wantOid: oid.T_timestamptz,
+			want:    "2024-01-01T12:00:00.000000Z",
+		},
+		{
+			name: "timestamp in session time zone",
+			dt:   &arrow.TimestampType{Unit: arrow.Microsecond, TimeZone: "UTC"},
+			append: func(b array.Builder) {
+				b.(*array.TimestampBuilder).Append(arrow.Timestamp(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC).UnixMicro()))
+			},
+			loc:     berlin,
+			wantOid: oid.T_timestamptz,
+			want:    "2024-01-01T13:00:00.000000+01:00",
+		},
+		{
+			name: "decimal",
+			dt:   &arrow.Decimal128Type{Precision: 10, Scale: 2},
+			append: func(b array.Builder) {
+				b.(*array.Decimal128Builder).Append(decimal128.FromI64(-12345))
+			},
+			wantOid: oid.T_numeric,
+			want:    "-123.45",
+		},
+		{
+			name: "interval",
+			dt:   arrow.FixedWidthTypes.MonthDayNanoInterval,
+			append: func(b array.Builder) {
+				b.(*array.MonthDayNanoIntervalBuilder).Append(arrow.MonthDayNanoInterval{Months: 14, Days: 3, Nanoseconds: int64(90 * time.Minute)})
+			},
+			wantOid: oid.T_interval,
+			want:    formatInterval(14, 3, 90*time.Minute),
+		},
+		{
+			name: "uuid",
+			dt:   &arrow.FixedSizeBinaryType{ByteWidth: 16},
+			append: func(b array.Builder) {
+				b.(*array.FixedSizeBinaryBuilder).Append([]byte{0x12, 0x3e, 0x45, 0x67, 0xe8, 0x9b, 0x12, 0xd3, 0xa4, 0x56, 0x42, 0x66, 0x14, 0x17, 0x40, 0x00})
+			},
+			wantOid: oid.T_uuid,
+			want:    "123e4567-e89b-12d3-a456-426614174000",
+		},
+		{
+			name:    "null",
+			dt:      arrow.PrimitiveTypes.Int64,
+			append:  func(b array.Builder) { b.AppendNull() },
+			wantOid: oid.T_int8,
+			want:    nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := arrowTypeToPgOid(tt.dt); err != nil || got != tt.wantOid {
+				t.Errorf("arrowTypeToPgOid(%s) = %v, %v, want %v", tt.dt, got, err, tt.wantOid)
+			}
+
+			arr := newArray(tt.dt, tt.append)
+			defer arr.Release()
+
+			loc := tt.loc
+			if loc == nil {
+				loc = time.UTC
+			}
+			got, err := arrowValueToInterface(arr, 0, loc)
+			if err != nil {
+				t.Fatalf("arrowValueToInterface returned error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("arrowValueToInterface = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUint64MaxRoundTrip(t *testing.T) {
+	logfire := newFakeLogfire(t, func(sql string) arrow.Record {
+		schema := arrow.NewSchema([]arrow.Field{{Name: "n", Type: arrow.PrimitiveTypes.Uint64}}, nil)
+		builder := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+		defer builder.Release()
+		builder.Field(0).(*array.Uint64Builder).Append(math.MaxUint64)
+		return builder.NewRecord()
+	})
+	db := openTestDB(t, startTestServer(t, logfire.URL, serverConfig{}))
+
+	var n string
+	if err := db.QueryRow("SELECT n FROM records").Scan(&n); err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if n != "18446744073709551615" {
+		t.Errorf("query returned %s, want 18446744073709551615", n)
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"127.0.0.1", "127.0.0.1:5432"},
+		{"localhost", "localhost:5432"},
+		{"::1", "[::1]:5432"},
+		{"[::1]", "[::1]:5432"},
+		{"::", "[::]:5432"},
+		{"0:0:0:0:0:0:0:1", "[0:0:0:0:0:0:0:1]:5432"},
+	}
+
+	for _, tt := range tests {
+		if got := listenAddress(tt.host, 5432); got != tt.want {
+			t.Errorf("listenAddress(%q, 5432) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestIPv6RoundTrip(t *testing.T) {
+	listener, err := net.Listen("tcp", listenAddress("[::1]", 0))
+	if err != nil {
+		t.Skipf("IPv6 loopback is not available: %v", err)
+	}
+
+	logfire := newFakeLogfire(t, func(sql string) arrow.Record {
+		return int64Record("n", 1)
+	})
+	dsn := serveTestServer(t, listener, logfire.URL, serverConfig{})
+	if !strings.Contains(dsn, "@[::1]:") {
+		t.Fatalf("server is not listening on [::1]: %s", dsn)
+	}
+
+	var n int64
+	if err := openTestDB(t, dsn).QueryRow("SELECT n FROM records").Scan(&n); err != nil {
+		t.Fatalf("query over IPv6 failed: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("query over IPv6 returned %d, want 1", n)
+	}
+}
+
+func TestArrowValueToInterfaceRunEndEncoded(t *testing.T) {
+	dt := arrow.RunEndEncodedOf(arrow.PrimitiveTypes.Int32, arrow.PrimitiveTypes.Int32)
+	builder := array.NewRunEndEncodedBuilder(memory.DefaultAllocator, arrow.PrimitiveTypes.Int32, arrow.PrimitiveTypes.Int32)
+	defer builder.Release()
+	values := builder.ValueBuilder().(*array.Int32Builder)
+	builder.Append(3)
+	values.Append(1)
+	builder.Append(2)
+	values.Append(2)
+
+	arr := builder.NewArray()
+	defer arr.Release()
+
+	if got, err := arrowTypeToPgOid(dt); err != nil || got != oid.T_int4 {
+		t.Errorf("arrowTypeToPgOid(%s) = %v, %v, want %v", dt, got, err, oid.T_int4)
+	}
+
+	var got []any
+	for i := range arr.Len() {
+		value, err := arrowValueToInterface(arr, i, time.UTC)
+		if err != nil {
+			t.Fatalf("arrowValueToInterface(run-end encoded, %d) returned error: %v", i, err)
+		}
+		got = append(got, value)
+	}
+
+	if want := []any{1.0, 1.0, 1.0, 2.0, 2.0}; !slices.Equal(got, want) {
+		t.Errorf("arrowValueToInterface(run-end encoded) = %v, want %v", got, want)
+	}
+}
+
+func BenchmarkArrowValueToInterface(b *testing.B) {
+	const rows = 1024
+	mem := memory.DefaultAllocator
+	listType := arrow.ListOf(arrow.BinaryTypes.String)
+
+	benchmarks := []struct {
+		name   string
+		dt     arrow.DataType
+		append func(array.Builder, int)
+	}{
+		{"string", arrow.BinaryTypes.String, func(b array.Builder, i int) {
+			b.(*array.StringBuilder).Append("GET /api/v1/records")
+		}},
+		{"int64", arrow.PrimitiveTypes.Int64, func(b array.Builder, i int) {
+			b.(*array.Int64Builder).Append(int64(i))
+		}},
+		{"float64", arrow.PrimitiveTypes.Float64, func(b array.Builder, i int) {
+			b.(*array.Float64Builder).Append(float64(i) / 3)
+		}},
+		{"timestamp", &arrow.TimestampType{Unit: arrow.Microsecond, TimeZone: "UTC"}, func(b array.Builder, i int) {
+			b.(*array.TimestampBuilder).Append(arrow.Timestamp(1704110400000000 + int64(i)))
+		}},
+		{"list", listType, func(b array.Builder, i int) {
+			list := b.(*array.ListBuilder)
+			list.Append(true)
+			list.ValueBuilder().(*array.StringBuilder).AppendValues([]string{"a", "b", "c"}, nil)
+		}},
+		{"decimal", &arrow.Decimal128Type{Precision: 18, Scale: 4}, func(b array.Builder, i int) {
+			b.(*array.Decimal128Builder).Append(decimal128.FromI64(int64(i) * 12345))
+		}},
+		{"interval", arrow.FixedWidthTypes.MonthDayNanoInterval, func(b array.Builder, i int) {
+			b.(*array.MonthDayNanoIntervalBuilder).Append(arrow.MonthDayNanoInterval{Days: int32(i), Nanoseconds: int64(time.Hour)})
+		}},
+		{"uuid", &arrow.FixedSizeBinaryType{ByteWidth: 16}, func(b array.Builder, i int) {
+			b.(*array.FixedSizeBinaryBuilder).Append([]byte{0x12, 0x3e, 0x45, 0x67, 0xe8, 0x9b, 0x12, 0xd3, 0xa4, 0x56, 0x42, 0x66, 0x14, 0x17, 0x40, byte(i)})
+		}},
+	}
+
+	for _, bm := range benchmarks {
+		builder := array.NewBuilder(mem, bm.dt)
+		for i := range rows {
+			bm.append(builder, i)
+		}
+		arr := builder.NewArray()
+		builder.Release()
+
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := range b.N {
+				if _, err := arrowValueToInterface(arr, i%rows, time.UTC); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		arr.Release()
+	}
+}
+
+// psqlDescribeQuery is the query psql runs for \d records.
+const psqlDescribeQuery = `SELECT c.oid,
+  n.nspname,
+  c.relname
+FROM pg_catalog.pg_class c
+     LEFT JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relname OPERATOR(pg_catalog.~) '^(records)$' COLLATE pg_catalog.default
+  AND pg_catalog.pg_table_is_visible(c.oid)
+ORDER BY 2, 3;`
+
+// psqlDescribeSchemaQuery is the query psql runs for \d public.records.
+const psqlDescribeSchemaQuery = `SELECT c.oid,
+  n.nspname,
+  c.relname
+FROM pg_catalog.pg_class c
+     LEFT JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relname OPERATOR(pg_catalog.~) '^(records)$' COLLATE pg_catalog.default
+  AND n.nspname OPERATOR(pg_catalog.~) '^(public)$' COLLATE pg_catalog.default
+ORDER BY 2, 3;`
+
+// psqlListTablesQuery is the query psql runs for \dt.
+const psqlListTablesQuery = `SELECT n.nspname as "Schema",
+  c.relname as "Name",
+  CASE c.relkind WHEN 'r' THEN 'table' WHEN 'v' THEN 'view' WHEN 'm' THEN 'materialized view' WHEN 'i' THEN 'index' WHEN 'S' THEN 'sequence' WHEN 't' THEN 'TOAST table' WHEN 'f' THEN 'foreign table' WHEN 'p' THEN 'partitioned table' WHEN 'I' THEN 'partitioned index' END as "Type",
+  pg_catalog.pg_get_userbyid(c.relowner) as "Owner"
+FROM pg_catalog.pg_class c
+     LEFT JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+     LEFT JOIN pg_catalog.pg_am am ON am.oid = c.relam
+WHERE c.relkind IN ('r','p','')
+      AND n.nspname <> 'pg_catalog'
+      AND n.nspname !~ '^pg_toast'
+      AND n.nspname <> 'information_schema'
+  AND pg_catalog.pg_table_is_visible(c.oid)
+ORDER BY 1,2;`
+
+func TestDetectPsqlCommandQuery(t *testing.T) {
+	tests := []struct {
+		name          string
+		query         string
+		wantCommand   string
+		wantSuggested string
+		wantIsPsql    bool
+	}{
+		{
+			name:          `\dt`,
+			query:         psqlListTablesQuery,
+			wantCommand:   `\dt`,
+			wantSuggested: "show tables;",
+			wantIsPsql:    true,
+		},
+		{
+			name:          `\d without schema`,
+			query:         psqlDescribeQuery,
+			wantCommand:   `\d records`,
+			wantSuggested: "show columns from records;",
+			wantIsPsql:    true,
+		},
+		{
+			name:          `\d with schema`,
+			query:         psqlDescribeSchemaQuery,
+			wantCommand:   `\d public.records`,
+			wantSuggested: "show columns from public.records;",
+			wantIsPsql:    true,
+		},
+		{
+			name:  "not a psql command",
+			query: "SELECT * FROM records WHERE service_name = 'api'",
+		},
+		{
+			name:  `partial match of \d`,
+			query: strings.TrimSuffix(psqlDescribeQuery, "ORDER BY 2, 3;"),
+		},
+		{
+			name:  `\dt with an extra condition`,
+			query: strings.Replace(psqlListTablesQuery, "ORDER BY", "AND c.relname = 'records' ORDER BY", 1),
+		},
+		{
+			name:  `unsupported \ef`,
+			query: "SELECT 'my_function'::pg_catalog.regproc::pg_catalog.oid",
+		},
+		{
+			name:  "empty",
+			query: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command, suggested, isPsql := DetectPsqlCommandQuery(tt.query)
+			if command != tt.wantCommand || suggested != tt.wantSuggested || isPsql != tt.wantIsPsql {
+				t.Errorf("DetectPsqlCommandQuery() = %q, %q, %v, want %q, %q, %v", command, suggested, isPsql, tt.wantCommand, tt.wantSuggested, tt.wantIsPsql)
+			}
+		})
+	}
+}
+
+func FuzzDetectPsqlCommandQuery(f *testing.F) {
+	for _, query := range []string{
+		psqlListTablesQuery,
+		psqlDescribeQuery,
+		psqlDescribeSchemaQuery,
+		"SELECT 'my_function'::pg_catalog.regproc::pg_catalog.oid",
+		"SELECT * FROM records",
+		"",
+	} {
+		f.Add(query)
+	}
+
+	f.Fuzz(func(t *testing.T, query string) {
+		command, suggested, isPsql := DetectPsqlCommandQuery(query)
+		if isPsql && (command == "" || suggested == "") {
+			t.Errorf("DetectPsqlCommandQuery(%q) = %q, %q, true, want a command and a suggested query", query, command, suggested)
+		}
+		if !isPsql && (command != "" || suggested != "") {
+			t.Errorf("DetectPsqlCommandQuery(%q) = %q, %q, false, want no command or suggested query", query, command, suggested)
+		}
+	})
+}
+
+// BenchmarkExecuteQuery compares concurrent queries to a TLS endpoint sent with the default transport,
+// which keeps at most 2 idle connections per host and has to open a new connection for most
+// queries, and with the transport of newHTTPClient.
+func BenchmarkExecuteQuery(b *testing.B) {
+	logfire := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record := int64Record("n", 1)
+		defer record.Release()
+		writer := ipc.NewWriter(w, ipc.WithSchema(record.Schema()))
+		writer.Write(record)
+		writer.Close()
+	}))
+	var conns atomic.Int64
+	logfire.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	defer logfire.Close()
+	tlsConfig := logfire.Client().Transport.(*http.Transport).TLSClientConfig
+
+	defaultTransport := http.DefaultTransport.(*http.Transport).Clone()
+	defaultTransport.TLSClientConfig = tlsConfig
+	tunedClient := newHTTPClient(100, time.Minute)
+	tunedClient.Transport.(*http.Transport).TLSClientConfig = tlsConfig
+
+	for _, bm := range []struct {
+		name   string
+		client *http.Client
+	}{
+		{"default transport", &http.Client{Transport: defaultTransport}},
+		{"newHTTPClient", tunedClient},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			conns.Store(0)
+			defer func() { b.ReportMetric(float64(conns.Load())/float64(b.N), "conns/op") }()
+			b.SetParallelism(32)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					body, err := executeQuery(context.Background(), bm.client, logfire.URL, "bench", "SELECT 1", testToken)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					io.Copy(io.Discard, body)
+					body.Close()
+				}
+			})
+		})
+	}
+}
+
+// benchmarkRow keeps the rows built by BenchmarkRowBuilding alive, like writer.Row using them would.
+var benchmarkRow []any
+
+// BenchmarkRowBuilding compares allocating a row for every row of a record batch with reusing a single
+// row for the whole result, as executeStatement does since writer.Row encodes the values right away.
+func BenchmarkRowBuilding(b *testing.B) {
+	const rows = 10000
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "a", Type: arrow.PrimitiveTypes.Float64},
+		{Name: "b", Type: arrow.PrimitiveTypes.Float64},
+		{Name: "c", Type: arrow.FixedWidthTypes.Boolean},
+		{Name: "d", Type: arrow.PrimitiveTypes.Float64},
+	}, nil)
+	builder := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	for i := range rows {
+		builder.Field(0).(*array.Float64Builder).Append(float64(i))
+		builder.Field(1).(*array.Float64Builder).Append(float64(i) / 2)
+		builder.Field(2).(*array.BooleanBuilder).Append(i%2 == 0)
+		builder.Field(3).(*array.Float64Builder).Append(float64(i) / 3)
+	}
+	record := builder.NewRecord()
+	builder.Release()
+	defer record.Release()
+	numCols := int(record.NumCols())
+
+	buildRows := func(b *testing.B, newRow func() []any) {
+		b.ReportAllocs()
+		for range b.N {
+			for i := range rows {
+				row := newRow()
+				for j := range numCols {
+					val, err := arrowValueToInterface(record.Column(j), i, time.UTC)
+					if err != nil {
+						b.Fatal(err)
+					}
+					row[j] = val
+				}
+				benchmarkRow = row
+			}
+		}
+	}
+
+	b.Run("row per row", func(b *testing.B) {
+		buildRows(b, func() []any { return make([]any, numCols) })
+	})
+	b.Run("reused row", func(b *testing.B) {
+		row := make([]any, numCols)
+		buildRows(b, func() []any { return row[:numCols] })
+	})
+}
+
+// BenchmarkDetectPsqlCommandQuery compares DetectPsqlCommandQuery, whose patterns are compiled once,
+// with compiling the \d patterns on every call, as it did before.
+func BenchmarkDetectPsqlCommandQuery(b *testing.B) {
+	queries := []struct {
+		name  string
+		query string
+	}{
+		{"describe", psqlDescribeSchemaQuery},
+		{"other query", "SELECT * FROM records WHERE service_name = 'api' LIMIT 10"},
+	}
+
+	for _, q := range queries {
+		b.Run("precompiled/"+q.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				DetectPsqlCommandQuery(q.query)
+			}
+		})
+		b.Run("compiled per call/"+q.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				dPattern := regexp.MustCompile(psqlDescribePattern.String())
+				dSchemaPattern := regexp.MustCompile(psqlDescribeSchemaPattern.String())
+				normalized := strings.Join(strings.Fields(q.query), " ")
+				if !dPattern.MatchString(normalized) {
+					dSchemaPattern.MatchString(normalized)
+				}
+			}
+		})
+	}
+}
+
+func TestMultipleRecordBatches(t *testing.T) {
+	logfire := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		batches := []arrow.Record{int64Record("n", 1, 2), int64Record("n"), int64Record("n", 3, 4, 5)}
+		writer := ipc.NewWriter(w, ipc.WithSchema(batches[0].Schema()))
+		for _, batch := range batches {
+			if err := writer.Write(batch); err != nil {
+				t.Errorf("failed to write record: %v", err)
+			}
+			batch.Release()
+		}
+		writer.Close()
+	}))
+	defer logfire.Close()
+	db := openTestDB(t, startTestServer(t, logfire.URL, serverConfig{}))
+
+	rows, err := db.Query("SELECT n FROM records")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	defer rows.Close()
+
+	if columns, err := rows.Columns(); err != nil || !slices.Equal(columns, []string{"n"}) {
+		t.Errorf("query returned columns %q, %v, want [n]", columns, err)
+	}
+
+	var got []int64
+	for rows.Next() {
+		var n int64
+		if err := rows.Scan(&n); err != nil {
+			t.Fatalf("failed to scan row: %v", err)
+		}
+		got = append(got, n)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if want := []int64{1, 2, 3, 4, 5}; !slices.Equal(got, want) {
+		t.Errorf("query returned %v, want %v", got, want)
+	}
+
+	// lib/pq reports the row count of the command tag, SELECT 5, as rows affected
+	result, err := db.Exec("SELECT n FROM records")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 5 {
+		t.Errorf("query completed with %d rows, %v, want 5", n, err)
+	}
+}
+
+// roundTripFunc is an http.RoundTripper answering requests with a function.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestExecuteQueryClient(t *testing.T) {
+	var body bytes.Buffer
+	record := int64Record("n", 7)
+	writer := ipc.NewWriter(&body, ipc.WithSchema(record.Schema()))
+	if err := writer.Write(record); err != nil {
+		t.Fatalf("failed to write record: %v", err)
+	}
+	writer.Close()
+	record.Release()
+
+	var request *http.Request
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		request = r
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/vnd.apache.arrow.stream"}},
+			Body:       io.NopCloser(bytes.NewReader(body.Bytes())),
+		}, nil
+	})}
+
+	respBody, err := executeQuery(context.Background(), client, "https://logfire.test", "logfire-pg/test", "SELECT n FROM records", testToken)
+	if err != nil {
+		t.Fatalf("executeQuery returned error: %v", err)
+	}
+	defer respBody.Close()
+
+	if got := request.URL.String(); got != "https://logfire.test/v1/query?sql=SELECT+n+FROM+records" {
+		t.Errorf("request URL = %s", got)
+	}
+	for header, want := range map[string]string{
+		"Authorization": "Bearer " + testToken,
+		"Accept":        "application/vnd.apache.arrow.stream",
+		"User-Agent":    "logfire-pg/test",
+	} {
+		if got := request.Header.Get(header); got != want {
+			t.Errorf("request header %s = %q, want %q", header, got, want)
+		}
+	}
+
+	reader, err := ipc.NewReader(respBody)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	defer reader.Release()
+	if !reader.Next() || reader.Record().Column(0).(*array.Int64).Value(0) != 7 {
+		t.Errorf("response does not contain the record returned by the client")
+	}
+}
+
+func TestExecuteQueryClientError(t *testing.T) {
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusTooManyRequests,
+			Header:     http.Header{"Retry-After": {"3"}},
+			Body:       io.NopCloser(strings.NewReader("rate limited")),
+		}, nil
+	})}
+
+	_, err := executeQuery(context.Background(), client, "https://logfire.test", "logfire-pg/test", "SELECT 1", testToken)
+	var qErr *queryError
+	if !errors.As(err, &qErr) {
+		t.Fatalf("executeQuery returned %v, want a *queryError", err)
+	}
+	if qErr.StatusCode != http.StatusTooManyRequests || qErr.Body != "rate limited" || qErr.RetryAfter != 3*time.Second {
+		t.Errorf("executeQuery returned %+v", qErr)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics, served on --metrics-addr when set.
+var (
+	queriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "logfire_pg_queries_total",
+		Help: "Number of queries forwarded to Logfire, by status.",
+	}, []string{"status"})
+
+	queryDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "logfire_pg_query_duration_seconds",
+		Help:    "Time from receiving a query forwarded to Logfire until its last row was sent.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+	})
+
+	rowsReturnedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "logfire_pg_rows_returned_total",
+		Help: "Number of rows sent to clients.",
+	})
+
+	activeConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "logfire_pg_active_connections",
+		Help: "Number of open client connections.",
+	})
+
+	authenticationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "logfire_pg_authentications_total",
+		Help: "Number of authentication attempts, by status.",
+	}, []string{"status"})
+)
+
+// metricsStatus returns the status label for an operation that finished with the given error.
+func metricsStatus(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// recordQuery records the outcome of a query forwarded to Logfire that was received at start.
+func recordQuery(start time.Time, err error) {
+	queriesTotal.WithLabelValues(metricsStatus(err)).Inc()
+	queryDuration.Observe(time.Since(start).Seconds())
+}
+
+// serveMetrics serves the Prometheus metrics on /metrics at the given address.
+func serveMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return http.ListenAndServe(addr, mux)
+}
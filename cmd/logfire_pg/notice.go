@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+
+	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/jeroenrinzema/psql-wire/pkg/buffer"
+	"github.com/jeroenrinzema/psql-wire/pkg/types"
+)
+
+type sessionWriterCtxKey struct{}
+
+// keepWriter wraps the given auth strategy to add the writer of the connection to the context, which
+// psql-wire keeps for the whole session, so that notices can be sent with sendNotice. psql-wire has
+// no API for notices itself.
+func keepWriter(next wire.AuthStrategy) wire.AuthStrategy {
+	return func(ctx context.Context, writer *buffer.Writer, reader *buffer.Reader) (context.Context, error) {
+		ctx = context.WithValue(ctx, sessionWriterCtxKey{}, writer)
+		return next(ctx, writer, reader)
+	}
+}
+
+// sendNotice sends a NoticeResponse with the given message to the client of the session context.
+// It must only be called while handling a message of the client, when psql-wire isn't writing to the
+// connection itself. Clients accept notices at any time, e.g. before the ParseComplete of a statement.
+func sendNotice(ctx context.Context, message string) error {
+	writer, ok := ctx.Value(sessionWriterCtxKey{}).(*buffer.Writer)
+	if !ok {
+		return nil
+	}
+
+	writer.Start(types.ServerNoticeResponse)
+	for _, field := range []struct {
+		code  byte
+		value string
+	}{
+		{'S', "NOTICE"},
+		{'V', "NOTICE"},
+		{'C', "00000"},
+		{'M', message},
+	} {
+		writer.AddByte(field.code)
+		writer.AddString(field.value)
+		writer.AddNullTerminate()
+	}
+	writer.AddByte(0)
+	return writer.End()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"database/sql"
+	"slices"
+	"testing"
+
+	"github.com/apache/arrow/go/v18/arrow"
+	"github.com/lib/pq"
+)
+
+func TestNotices(t *testing.T) {
+	logfire := newFakeLogfire(t, func(sql string) arrow.Record {
+		t.Errorf("unexpected query forwarded to Logfire: %s", sql)
+		return int64Record("n")
+	})
+	dsn := startTestServer(t, logfire.URL, serverConfig{})
+
+	connector, err := pq.NewConnector(dsn)
+	if err != nil {
+		t.Fatalf("failed to create connector: %v", err)
+	}
+	var notices []string
+	db := sql.OpenDB(pq.ConnectorWithNoticeHandler(connector, func(notice *pq.Error) {
+		notices = append(notices, string(notice.Severity)+": "+notice.Message)
+	}))
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	var cancelled bool
+	if err := db.QueryRow("SELECT pg_cancel_backend(12345)").Scan(&cancelled); err != nil {
+		t.Fatalf("pg_cancel_backend failed: %v", err)
+	}
+	if cancelled {
+		t.Errorf("pg_cancel_backend returned true, want false")
+	}
+
+	if _, err := db.Exec("LISTEN events"); err != nil {
+		t.Fatalf("LISTEN failed: %v", err)
+	}
+
+	want := []string{
+		"NOTICE: Query cancellation by PID is not supported in logfire-pg; close the client connection to cancel.",
+		"NOTICE: Asynchronous notifications are not supported by logfire-pg",
+	}
+	if !slices.Equal(notices, want) {
+		t.Errorf("received notices %q, want %q", notices, want)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/lib/pq/oid"
+)
+
+// parameterPattern matches positional parameters, such as $1, in plain SQL.
+var parameterPattern = regexp.MustCompile(`\$(\d+)`)
+
+// numericLiteralPattern matches parameter values that are substituted as numeric constants: decimal
+// integers and floats without leading zeros or plus sign, with an optional exponent.
+var numericLiteralPattern = regexp.MustCompile(`^-?(?:0|[1-9][0-9]*)(?:\.[0-9]+)?(?:[eE][+-]?[0-9]+)?$`)
+
+// replaceParameters calls fn for each positional parameter of the given query, outside of string
+// constants and comments, and returns the query with the parameters replaced by the result.
+func replaceParameters(query string, fn func(n int) (string, error)) (string, error) {
+	return replaceInCode(query, parameterPattern, func(match []int) (string, bool, error) {
+		// A $ following an identifier is part of it
+		if isIdentifierChar(query, match[0]-1) {
+			return "", false, nil
+		}
+
+		n, err := strconv.Atoi(query[match[2]:match[3]])
+		if err != nil {
+			return "", false, fmt.Errorf("invalid parameter %s", query[match[0]:match[1]])
+		}
+
+		replacement, err := fn(n)
+		return replacement, true, err
+	})
+}
+
+// queryParameters returns the number of positional parameters of the given query, i.e. the highest
+// parameter number it references.
+func queryParameters(query string) int {
+	parameters := 0
+	replaceParameters(query, func(n int) (string, error) {
+		parameters = max(parameters, n)
+		return "", nil
+	})
+	return parameters
+}
+
+// textParameterTypes returns the types of the given number of parameters, which are all described to
+// clients as text.
+func textParameterTypes(n int) []oid.Oid {
+	types := make([]oid.Oid, n)
+	for i := range types {
+		types[i] = oid.T_text
+	}
+	return types
+}
+
+// substituteParams returns the given query with its positional parameters replaced by the literal
+// values of params, as the Logfire API has no support for bind parameters. Parameters are described
+// to clients as text, so their values are decoded as such regardless of their format. psql-wire
+// discards the parameter types clients declare in their Parse message, so values that are numbers are
+// substituted as numeric constants, e.g. for LIMIT $1, and all other values as string constants.
+func substituteParams(query string, params []wire.Parameter) (string, error) {
+	return replaceParameters(query, func(n int) (string, error) {
+		if n < 1 || n > len(params) {
+			return "", fmt.Errorf("there is no parameter $%d", n)
+		}
+
+		param := params[n-1]
+		if param.Value() == nil {
+			return "NULL", nil
+		}
+
+		value, err := param.Scan(uint32(oid.T_text))
+		if err != nil {
+			return "", fmt.Errorf("invalid value for parameter $%d: %w", n, err)
+		}
+		return paramLiteral(value.(string))
+	})
+}
+
+// paramLiteral returns the SQL constant for the given text parameter value.
+func paramLiteral(value string) (string, error) {
+	if strings.ContainsRune(value, 0) || !utf8.ValidString(value) {
+		return "", errors.New("invalid byte sequence for encoding \"UTF8\"")
+	}
+	if numericLiteralPattern.MatchString(value) {
+		// Negative numbers are parenthesized, so that e.g. 1 -$1 doesn't become a comment
+		if strings.HasPrefix(value, "-") {
+			return "(" + value + ")", nil
+		}
+		return value, nil
+	}
+	return quoteLiteral(value), nil
+}
+
+// quoteLiteral returns the given value as an SQL string constant. Backslashes need no escaping, as
+// standard_conforming_strings is on.
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// quoteIdentifier returns the given name as a quoted SQL identifier.
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// preflightQuery returns a query returning no rows but the result columns of the given query, with
+// its parameters set to NULL.
+func preflightQuery(query string) string {
+	if statements := splitStatements(query); len(statements) == 1 {
+		query = statements[0]
+	}
+
+	query, _ = replaceParameters(query, func(n int) (string, error) {
+		return "NULL", nil
+	})
+
+	// The query is put on its own lines, so that a trailing line comment doesn't hide the parenthesis
+	return fmt.Sprintf("SELECT * FROM (\n%s\n) AS preflight LIMIT 0", query)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	wire "github.com/jeroenrinzema/psql-wire"
+)
+
+// textParams returns parameters sent in text format with the given values, nil for NULL.
+func textParams(values ...*string) []wire.Parameter {
+	types := pgtype.NewMap()
+	params := make([]wire.Parameter, len(values))
+	for i, value := range values {
+		var raw []byte
+		if value != nil {
+			raw = []byte(*value)
+		}
+		params[i] = wire.NewParameter(types, wire.TextFormat, raw)
+	}
+	return params
+}
+
+func ptr(s string) *string {
+	return &s
+}
+
+func TestSubstituteParams(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		params []*string
+		want   string
+	}{
+		{
+			name:   "string",
+			query:  "SELECT * FROM records WHERE service_name = $1",
+			params: []*string{ptr("api")},
+			want:   "SELECT * FROM records WHERE service_name = 'api'",
+		},
+		{
+			name:   "quotes",
+			query:  "SELECT $1",
+			params: []*string{ptr("it's'; DROP TABLE records; --")},
+			want:   "SELECT 'it''s''; DROP TABLE records; --'",
+		},
+		{
+			name:   "backslashes",
+			query:  "SELECT $1",
+			params: []*string{ptr(`\' OR 1=1 --`)},
+			want:   `SELECT '\'' OR 1=1 --'`,
+		},
+		{
+			name:   "integer",
+			query:  "SELECT * FROM records LIMIT $1",
+			params: []*string{ptr("10")},
+			want:   "SELECT * FROM records LIMIT 10",
+		},
+		{
+			name:   "float",
+			query:  "SELECT * FROM records WHERE duration > $1",
+			params: []*string{ptr("0.5")},
+			want:   "SELECT * FROM records WHERE duration > 0.5",
+		},
+		{
+			name:   "exponent",
+			query:  "SELECT $1",
+			params: []*string{ptr("1.5e-3")},
+			want:   "SELECT 1.5e-3",
+		},
+		{
+			name:   "minus before a negative number",
+			query:  "SELECT 1 -$1",
+			params: []*string{ptr("-1")},
+			want:   "SELECT 1 -(-1)",
+		},
+		{
+			name:   "leading zero",
+			query:  "SELECT $1",
+			params: []*string{ptr("0123")},
+			want:   "SELECT '0123'",
+		},
+		{
+			name:   "plus sign",
+			query:  "SELECT $1",
+			params: []*string{ptr("+1")},
+			want:   "SELECT '+1'",
+		},
+		{
+			name:   "hexadecimal",
+			query:  "SELECT $1",
+			params: []*string{ptr("0x10")},
+			want:   "SELECT '0x10'",
+		},
+		{
+			name:   "trailing dot",
+			query:  "SELECT $1",
+			params: []*string{ptr("1.")},
+			want:   "SELECT '1.'",
+		},
+		{
+			name:   "number followed by SQL",
+			query:  "SELECT $1",
+			params: []*string{ptr("1 OR 1=1")},
+			want:   "SELECT '1 OR 1=1'",
+		},
+		{
+			name:   "number followed by newline",
+			query:  "SELECT $1",
+			params: []*string{ptr("1\n")},
+			want:   "SELECT '1\n'",
+		},
+		{
+			name:   "null",
+			query:  "SELECT $1",
+			params: []*string{nil},
+			want:   "SELECT NULL",
+		},
+		{
+			name:   "repeated and reordered",
+			query:  "SELECT $2, $1, $2",
+			params: []*string{ptr("a"), ptr("b")},
+			want:   "SELECT 'b', 'a', 'b'",
+		},
+		{
+			name:   "parameter in string constant",
+			query:  "SELECT '$1', $1",
+			params: []*string{ptr("a")},
+			want:   "SELECT '$1', 'a'",
+		},
+		{
+			name:   "parameter in quoted identifier",
+			query:  `SELECT "$1", $1`,
+			params: []*string{ptr("a")},
+			want:   `SELECT "$1", 'a'`,
+		},
+		{
+			name:   "parameter in dollar quoted string",
+			query:  "SELECT $$ $1 $$, $1",
+			params: []*string{ptr("a")},
+			want:   "SELECT $$ $1 $$, 'a'",
+		},
+		{
+			name:   "parameter in line comment",
+			query:  "SELECT $1 -- $1\n",
+			params: []*string{ptr("a")},
+			want:   "SELECT 'a' -- $1\n",
+		},
+		{
+			name:   "parameter in block comment",
+			query:  "SELECT /* $1 */ $1",
+			params: []*string{ptr("a")},
+			want:   "SELECT /* $1 */ 'a'",
+		},
+		{
+			name:   "dollar in identifier",
+			query:  "SELECT a$1 FROM records WHERE b = $1",
+			params: []*string{ptr("a")},
+			want:   "SELECT a$1 FROM records WHERE b = 'a'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := substituteParams(tt.query, textParams(tt.params...))
+			if err != nil {
+				t.Fatalf("substituteParams(%q) returned error: %v", tt.query, err)
+			}
+			if got != tt.want {
+				t.Errorf("substituteParams(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubstituteParamsErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		params []*string
+	}{
+		{
+			name:   "missing parameter",
+			query:  "SELECT $2",
+			params: []*string{ptr("a")},
+		},
+		{
+			name:   "parameter zero",
+			query:  "SELECT $0",
+			params: []*string{ptr("a")},
+		},
+		{
+			name:   "NUL",
+			query:  "SELECT $1",
+			params: []*string{ptr("a\x00' OR 1=1")},
+		},
+		{
+			name:   "invalid UTF-8",
+			query:  "SELECT $1",
+			params: []*string{ptr("\xc0' OR 1=1 --")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := substituteParams(tt.query, textParams(tt.params...))
+			if err == nil {
+				t.Errorf("substituteParams(%q) = %q, want error", tt.query, got)
+			}
+		})
+	}
+}
+
+func TestQueryParameters(t *testing.T) {
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"SELECT 1", 0},
+		{"SELECT $1, $3", 3},
+		{"SELECT '$2', $1 -- $4", 1},
+		{"SELECT a$2", 0},
+	}
+
+	for _, tt := range tests {
+		if got := queryParameters(tt.query); got != tt.want {
+			t.Errorf("queryParameters(%q) = %d, want %d", tt.query, got, tt.want)
+		}
+	}
+}
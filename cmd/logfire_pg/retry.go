@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// retryPolicy controls how queries failing with transient errors are retried.
+type retryPolicy struct {
+	// MaxRetries is the number of retries after the initial attempt. Zero disables retries.
+	MaxRetries int
+	// BaseDelay is the delay before the first retry, doubled for every subsequent retry.
+	BaseDelay time.Duration
+	// MaxWait caps the delay asked for by the Retry-After header of rate limited queries.
+	MaxWait time.Duration
+}
+
+// delay returns the backoff before the given retry attempt (starting at 1), including jitter.
+func (p retryPolicy) delay(attempt int) time.Duration {
+	backoff := p.BaseDelay << (attempt - 1)
+	if p.BaseDelay <= 0 {
+		return backoff
+	}
+	return backoff + rand.N(p.BaseDelay)
+}
+
+// rateLimitDelay returns the delay before retrying a query the Logfire API rate limited, as asked for
+// by its Retry-After header but at most MaxWait, or the backoff of the given attempt without one.
+func (p retryPolicy) rateLimitDelay(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter <= 0 {
+		return p.delay(attempt)
+	}
+	if p.MaxWait > 0 && retryAfter > p.MaxWait {
+		return p.MaxWait
+	}
+	return retryAfter
+}
+
+// parseRetryAfter parses the value of a Retry-After header, given either in seconds or as an HTTP
+// date. It returns 0 if the value is missing or invalid.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+
+	return 0
+}
+
+// rateLimitError returns the error of a query the Logfire API rejected as it exceeded the rate limit.
+func rateLimitError(err error) (*queryError, bool) {
+	var qErr *queryError
+	if errors.As(err, &qErr) && qErr.StatusCode == http.StatusTooManyRequests {
+		return qErr, true
+	}
+	return nil, false
+}
+
+// isRetryable reports whether the given query error is transient: a network error, a 5xx response or
+// a rate limited query.
+func isRetryable(err error) bool {
+	var qErr *queryError
+	if errors.As(err, &qErr) {
+		return qErr.StatusCode >= 500 || qErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// isUnauthorized reports whether the Logfire API rejected the token a query was run with.
+func isUnauthorized(err error) bool {
+	var qErr *queryError
+	return errors.As(err, &qErr) && (qErr.StatusCode == http.StatusUnauthorized || qErr.StatusCode == http.StatusForbidden)
+}
+
+// executeQueryWithRetry runs executeQuery, retrying transient failures according to the server's
+// retry policy. Waiting between retries is aborted once the given context is done. Every attempt is
+// sent with the same request ID, which is logged along with the query. Reading the returned body fails
+// with errResponseTooLarge once it exceeds the maximum response size.
+func (s *PostgreServer) executeQueryWithRetry(ctx context.Context, sql string, token string) (io.ReadCloser, error) {
+	ctx, requestID, sessionRequestID := withRequestID(ctx)
+	s.logger.InfoContext(ctx, "forwarding query to Logfire", "query", sql, "request_id", requestID)
+	s.logger.DebugContext(ctx, "session request ID", "query", sql, "request_id", requestID, "session_request_id", sessionRequestID)
+
+	for attempt := 0; ; attempt++ {
+		respBody, err := executeQuery(ctx, s.httpClient, s.baseURL, s.userAgent, sql, token)
+		if isUnauthorized(err) && s.tokenCache != nil {
+			// The token may have been revoked since it was cached
+			s.tokenCache.remove(token)
+		}
+		rateLimitErr, rateLimited := rateLimitError(err)
+		if rateLimited {
+			s.logger.WarnContext(ctx, "query rate limited by Logfire", "request_id", requestID, "retry_after", rateLimitErr.RetryAfter)
+		}
+		if err == nil && s.maxResponseBytes > 0 {
+			respBody = &limitedBody{ReadCloser: respBody, remaining: s.maxResponseBytes}
+		}
+		if err == nil || attempt >= s.retryPolicy.MaxRetries || !isRetryable(err) {
+			return respBody, err
+		}
+
+		delay := s.retryPolicy.delay(attempt + 1)
+		if rateLimited {
+			delay = s.retryPolicy.rateLimitDelay(attempt+1, rateLimitErr.RetryAfter)
+		}
+		s.logger.WarnContext(ctx, "query failed, retrying", "request_id", requestID, "delay", delay, "attempt", attempt+1, "max_retries", s.retryPolicy.MaxRetries, "err", err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+	// The container image has no zoneinfo database to load the session time zones from
+	_ "time/tzdata"
+)
+
+type sessionStateCtxKey struct{}
+
+// sessionState holds the per-connection state maintained by logfire-pg, such as the run-time
+// parameters changed with SET.
+type sessionState struct {
+	// id is a random UUID identifying the session in the X-Logfire-PG-Request-ID header of its queries.
+	id string
+	// querySeq numbers the queries the session forwarded to Logfire.
+	querySeq   atomic.Uint64
+	parameters map[string]string
+	// defaults overrides serverParameters for the session, with values that are known once the client
+	// connected. Unlike parameters, they are kept by RESET.
+	defaults map[string]string
+	stats    sessionStats
+	// closed is closed once the connection of the session is closed, nil outside of a session.
+	closed <-chan struct{}
+	// discardParsed discards the result of the statement handled last by wireHandler, if it was
+	// fetched right away and has yet to be executed. It is taken by statementCache.
+	discardParsed func()
+}
+
+// sessionStats accumulates the queries a session forwarded to Logfire. They are logged once the
+// connection is closed, to identify chatty or misbehaving clients.
+type sessionStats struct {
+	queries      atomic.Int64
+	rowsReturned atomic.Int64
+	errors       atomic.Int64
+	// duration is the total time spent on queries, in nanoseconds.
+	duration atomic.Int64
+}
+
+func newSessionState() *sessionState {
+	return &sessionState{
+		id:         newUUID(),
+		parameters: make(map[string]string),
+		defaults:   make(map[string]string),
+	}
+}
+
+// getSessionState returns the state of the session the given context belongs to. A fresh state is
+// returned for contexts outside of a session.
+func getSessionState(ctx context.Context) *sessionState {
+	state, ok := ctx.Value(sessionStateCtxKey{}).(*sessionState)
+	if !ok {
+		return newSessionState()
+	}
+	return state
+}
+
+// parameter returns the value of the given run-time parameter, preferring values changed with SET
+// over the session and server defaults.
+func (state *sessionState) parameter(name string) (string, bool) {
+	if value, ok := state.parameters[name]; ok {
+		return value, true
+	}
+	if value, ok := state.defaults[name]; ok {
+		return value, true
+	}
+
+	value, ok := serverParameters[name]
+	return value, ok
+}
+
+// applicationName returns the application_name of the session the given context belongs to, as sent
+// by the client when connecting or changed with SET.
+func applicationName(ctx context.Context) string {
+	name, _ := getSessionState(ctx).parameter("application_name")
+	return name
+}
+
+// location returns the time zone of the session, set with SET TIME ZONE or SET timezone, which
+// timestamps are returned in.
+func (state *sessionState) location() *time.Location {
+	name, _ := state.parameter("timezone")
+	loc, err := loadTimeZone(name)
+	if err != nil {
+		// Time zones are validated when they are set
+		return time.UTC
+	}
+	return loc
+}
+
+// loadTimeZone returns the location of a time zone name, e.g. UTC or America/New_York, or of a UTC
+// offset in hours as accepted by SET TIME ZONE, e.g. -7 or 5.5.
+func loadTimeZone(name string) (*time.Location, error) {
+	if hours, err := strconv.ParseFloat(name, 64); err == nil {
+		return time.FixedZone(name, int(hours*3600)), nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil || name == "" || name == "Local" {
+		return nil, fmt.Errorf("invalid value for parameter \"TimeZone\": %q", name)
+	}
+	return loc, nil
+}
+
+// record adds a query that returned the given number of rows after running for the given duration.
+func (stats *sessionStats) record(rows int, duration time.Duration, err error) {
+	stats.queries.Add(1)
+	stats.rowsReturned.Add(int64(rows))
+	stats.duration.Add(int64(duration))
+	if err != nil {
+		stats.errors.Add(1)
+	}
+}
+
+// logAttrs returns the statistics as log attributes.
+func (stats *sessionStats) logAttrs() []any {
+	return []any{
+		"queries", stats.queries.Load(),
+		"rows_returned", stats.rowsReturned.Load(),
+		"errors", stats.errors.Load(),
+		"total_duration_ms", time.Duration(stats.duration.Load()).Milliseconds(),
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	wire "github.com/jeroenrinzema/psql-wire"
+)
+
+// statementCache is the wire.StatementCache of a session. It discards the results of statements run
+// when they were parsed, see handleStatement, that are never executed: the response of Logfire is
+// otherwise held, along with its connection, until the query times out. psql-wire ignores Close
+// messages, so a result is discarded once its statement is replaced, e.g. the unnamed statement by
+// the next query, or the session ends.
+type statementCache struct {
+	wire.DefaultStatementCache
+
+	mu sync.Mutex
+	// discards maps statement names to the function discarding their result, if it was fetched
+	// when they were parsed.
+	discards map[string]func()
+}
+
+func newStatementCache() wire.StatementCache {
+	return &statementCache{discards: make(map[string]func())}
+}
+
+func (c *statementCache) Set(ctx context.Context, name string, stmt *wire.PreparedStatement) error {
+	// The statement was just parsed by wireHandler, which left the function discarding its result
+	state := getSessionState(ctx)
+	discard := state.discardParsed
+	state.discardParsed = nil
+
+	c.mu.Lock()
+	previous := c.discards[name]
+	if discard != nil {
+		c.discards[name] = discard
+	} else {
+		delete(c.discards, name)
+	}
+	c.mu.Unlock()
+
+	if previous != nil {
+		previous()
+	}
+	return c.DefaultStatementCache.Set(ctx, name, stmt)
+}
+
+func (c *statementCache) Close() {
+	c.mu.Lock()
+	discards := c.discards
+	c.discards = nil
+	c.mu.Unlock()
+
+	for _, discard := range discards {
+		discard()
+	}
+	c.DefaultStatementCache.Close()
+}
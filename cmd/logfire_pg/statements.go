@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// dollarQuoteTagPattern matches the opening tag of a dollar-quoted string constant, such as $$ or $body$.
+var dollarQuoteTagPattern = regexp.MustCompile(`^\$(?:[A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+// segmentKind is the kind of a segment of a query returned by scanQuery.
+type segmentKind int
+
+const (
+	// codeSegment is plain SQL, such as keywords, identifiers, operators and parameters.
+	codeSegment segmentKind = iota
+	// quotedSegment is a string constant or a quoted identifier, including its quotes.
+	quotedSegment
+	// commentSegment is a line or block comment.
+	commentSegment
+)
+
+// scanQuery splits the given query into segments of plain SQL, quoted strings and comments, the way
+// the PostgreSQL lexer does, and calls fn with the kind and bounds of each segment in order.
+// Unterminated quotes and comments extend to the end of the query.
+func scanQuery(query string, fn func(kind segmentKind, start, end int)) {
+	start := 0
+	segment := func(kind segmentKind, i int, end int) {
+		end = min(end, len(query))
+		if start < i {
+			fn(codeSegment, start, i)
+		}
+		fn(kind, i, end)
+		start = end
+	}
+
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == '\'' && i > 0 && (query[i-1] == 'E' || query[i-1] == 'e') && !isIdentifierChar(query, i-2):
+			// Escape string constants may contain backslash-escaped quotes
+			end := i + 1
+			for ; end < len(query) && query[end] != '\''; end++ {
+				if query[end] == '\\' {
+					end++
+				}
+			}
+			segment(quotedSegment, i, end+1)
+		case c == '\'' || c == '"':
+			// Quotes are escaped by doubling them, which is handled as two adjacent segments
+			end := len(query)
+			if n := strings.IndexByte(query[i+1:], c); n >= 0 {
+				end = i + 1 + n + 1
+			}
+			segment(quotedSegment, i, end)
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			end := len(query)
+			if n := strings.IndexByte(query[i:], '\n'); n >= 0 {
+				end = i + n
+			}
+			segment(commentSegment, i, end)
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			// Block comments nest in PostgreSQL
+			depth := 0
+			end := i
+			for ; end < len(query); end++ {
+				if strings.HasPrefix(query[end:], "/*") {
+					depth++
+					end++
+				} else if strings.HasPrefix(query[end:], "*/") {
+					depth--
+					end++
+					if depth == 0 {
+						break
+					}
+				}
+			}
+			segment(commentSegment, i, end+1)
+		case c == '$':
+			tag := dollarQuoteTagPattern.FindString(query[i:])
+			if tag == "" || isIdentifierChar(query, i-1) {
+				continue
+			}
+			end := len(query)
+			if n := strings.Index(query[i+len(tag):], tag); n >= 0 {
+				end = i + len(tag) + n + len(tag)
+			}
+			segment(quotedSegment, i, end)
+		default:
+			continue
+		}
+
+		// Continue after the segment that was just emitted
+		i = start - 1
+	}
+
+	if start < len(query) {
+		fn(codeSegment, start, len(query))
+	}
+}
+
+// splitStatements splits the given query string into its individual statements on semicolons, the
+// way PostgreSQL does for simple queries. Semicolons inside string literals, quoted identifiers,
+// dollar-quoted strings and comments are ignored. Statements consisting only of whitespace and
+// comments are dropped, the returned statements do not include the terminating semicolon.
+func splitStatements(query string) []string {
+	var statements []string
+	start := 0
+	empty := true
+
+	flush := func(end int) {
+		if !empty {
+			statements = append(statements, strings.TrimSpace(query[start:end]))
+		}
+		start = end + 1
+		empty = true
+	}
+
+	scanQuery(query, func(kind segmentKind, segmentStart, segmentEnd int) {
+		switch kind {
+		case quotedSegment:
+			empty = false
+		case codeSegment:
+			for i := segmentStart; i < segmentEnd; i++ {
+				if query[i] == ';' {
+					flush(i)
+				} else if !isSpace(query[i]) {
+					empty = false
+				}
+			}
+		}
+	})
+	flush(len(query))
+
+	return statements
+}
+
+// replaceInCode returns the given query with the matches of pattern in plain SQL, outside of string
+// constants, quoted identifiers and comments, replaced by the result of fn. fn is called with the
+// submatch indexes of each match in query, and leaves the match unchanged when it returns false.
+func replaceInCode(query string, pattern *regexp.Regexp, fn func(match []int) (string, bool, error)) (string, error) {
+	var b strings.Builder
+	var err error
+	scanQuery(query, func(kind segmentKind, start, end int) {
+		if kind != codeSegment || err != nil {
+			b.WriteString(query[start:end])
+			return
+		}
+
+		last := start
+		for _, match := range pattern.FindAllStringSubmatchIndex(query[start:end], -1) {
+			for i := range match {
+				if match[i] >= 0 {
+					match[i] += start
+				}
+			}
+
+			replacement, ok, fnErr := fn(match)
+			if fnErr != nil {
+				err = fnErr
+				return
+			}
+			if !ok {
+				continue
+			}
+
+			b.WriteString(query[last:match[0]])
+			b.WriteString(replacement)
+			last = match[1]
+		}
+		b.WriteString(query[last:end])
+	})
+
+	return b.String(), err
+}
+
+// codeOnly returns the plain SQL of the given query, with string constants and quoted identifiers
+// emptied and comments replaced by a space, so that patterns matched against it can't match their
+// contents.
+func codeOnly(query string) string {
+	var b strings.Builder
+	scanQuery(query, func(kind segmentKind, start, end int) {
+		switch kind {
+		case codeSegment:
+			b.WriteString(query[start:end])
+		case quotedSegment:
+			// The quotes are kept, so that a string constant is still an operand
+			b.WriteByte(query[start])
+			b.WriteByte(query[start])
+		case commentSegment:
+			b.WriteByte(' ')
+		}
+	})
+	return b.String()
+}
+
+// firstKeyword returns the first keyword of the given statement in upper case, skipping comments and
+// opening parentheses.
+func firstKeyword(statement string) string {
+	keyword := ""
+	scanQuery(statement, func(kind segmentKind, start, end int) {
+		if keyword != "" || kind != codeSegment {
+			return
+		}
+		code := strings.TrimLeft(statement[start:end], " \t\n\r\f\v(")
+		if n := strings.IndexFunc(code, func(r rune) bool { return !unicode.IsLetter(r) }); n >= 0 {
+			code = code[:n]
+		}
+		keyword = strings.ToUpper(code)
+	})
+	return keyword
+}
+
+// commandTag returns the command tag PostgreSQL completes the given statement with, after it
+// returned or affected the given number of rows.
+func commandTag(statement string, rows int) string {
+	switch keyword := firstKeyword(statement); keyword {
+	case "INSERT":
+		return fmt.Sprintf("INSERT 0 %d", rows)
+	case "UPDATE", "DELETE", "MERGE", "COPY", "FETCH", "MOVE":
+		return fmt.Sprintf("%s %d", keyword, rows)
+	case "SHOW":
+		return "SHOW"
+	default:
+		// Including WITH, VALUES and TABLE, which complete like SELECT
+		return fmt.Sprintf("SELECT %d", rows)
+	}
+}
+
+// isIdentifierChar reports whether the byte at index i of query is part of an identifier, in which case
+// a following $ is part of the identifier or a parameter rather than opening a dollar quote.
+func isIdentifierChar(query string, i int) bool {
+	if i < 0 {
+		return false
+	}
+	c := query[i]
+	return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"single", "SELECT 1", []string{"SELECT 1"}},
+		{"trailing semicolon", "SELECT 1;", []string{"SELECT 1"}},
+		{"several", "SET search_path = public; SELECT 1", []string{"SET search_path = public", "SELECT 1"}},
+		{"empty statements", " ; SELECT 1;; ;", []string{"SELECT 1"}},
+		{"empty", "", nil},
+		{"only comments", "-- nothing\n/* to do */;", nil},
+		{"string constant", "SELECT ';'; SELECT 2", []string{"SELECT ';'", "SELECT 2"}},
+		{"doubled quote", "SELECT 'it''s;'; SELECT 2", []string{"SELECT 'it''s;'", "SELECT 2"}},
+		{"escape string", `SELECT E'\';'; SELECT 2`, []string{`SELECT E'\';'`, "SELECT 2"}},
+		{"quoted identifier", `SELECT 1 AS ";"; SELECT 2`, []string{`SELECT 1 AS ";"`, "SELECT 2"}},
+		{"dollar quotes", "SELECT $$;$$; SELECT $tag$ $$; $tag$", []string{"SELECT $$;$$", "SELECT $tag$ $$; $tag$"}},
+		{"parameter is not a dollar quote", "SELECT $1; SELECT $2", []string{"SELECT $1", "SELECT $2"}},
+		{"line comment", "SELECT 1 -- ; SELECT 2\n", []string{"SELECT 1 -- ; SELECT 2"}},
+		{"nested block comment", "SELECT /* /* ; */ ; */ 1; SELECT 2", []string{"SELECT /* /* ; */ ; */ 1", "SELECT 2"}},
+		{"unterminated string", "SELECT 'a; SELECT 2", []string{"SELECT 'a; SELECT 2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitStatements(tt.query); !slices.Equal(got, tt.want) {
+				t.Errorf("splitStatements(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFirstKeyword(t *testing.T) {
+	tests := []struct {
+		statement string
+		want      string
+	}{
+		{"select 1", "SELECT"},
+		{"  (SELECT 1) UNION (SELECT 2)", "SELECT"},
+		{"/* comment */ WITH x AS (SELECT 1) SELECT * FROM x", "WITH"},
+		{"-- comment\nshow tables", "SHOW"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := firstKeyword(tt.statement); got != tt.want {
+			t.Errorf("firstKeyword(%q) = %q, want %q", tt.statement, got, tt.want)
+		}
+	}
+}
+
+func TestCodeOnly(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT 1", "SELECT 1"},
+		{"SELECT 'a;b', \"c\" -- d\n", "SELECT '', \"\"  \n"},
+		{"SELECT /* x */ $$y$$", "SELECT   $$"},
+	}
+
+	for _, tt := range tests {
+		if got := codeOnly(tt.query); got != tt.want {
+			t.Errorf("codeOnly(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
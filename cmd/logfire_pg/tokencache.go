@@ -0,0 +1,92 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// tokenCacheSize is the maximum number of tokens remembered by a tokenCache.
+const tokenCacheSize = 1024
+
+// tokenCache remembers read tokens that were recently validated against the Logfire API, so that new
+// connections using them can skip the validation request. Tokens are stored as SHA-256 hashes and
+// the least recently used one is evicted once the cache is full.
+type tokenCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[[sha256.Size]byte]*list.Element
+	// lru holds *tokenCacheEntry values, most recently used first.
+	lru *list.List
+}
+
+type tokenCacheEntry struct {
+	key     [sha256.Size]byte
+	expires time.Time
+}
+
+func newTokenCache(ttl time.Duration) *tokenCache {
+	return &tokenCache{
+		ttl:     ttl,
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// valid reports whether the given token was validated within the TTL.
+func (c *tokenCache) valid(token string) bool {
+	key := sha256.Sum256([]byte(token))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(elem.Value.(*tokenCacheEntry).expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return false
+	}
+
+	c.lru.MoveToFront(elem)
+	return true
+}
+
+// add records the given token as valid for the TTL.
+func (c *tokenCache) add(token string) {
+	key := sha256.Sum256([]byte(token))
+	expires := time.Now().Add(c.ttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*tokenCacheEntry).expires = expires
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&tokenCacheEntry{key: key, expires: expires})
+	if c.lru.Len() > tokenCacheSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*tokenCacheEntry).key)
+	}
+}
+
+// remove forgets the given token, e.g. after the Logfire API rejected it.
+func (c *tokenCache) remove(token string) {
+	key := sha256.Sum256([]byte(token))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+	}
+}
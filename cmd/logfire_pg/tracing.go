@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer traces queries and the requests made to the Logfire API. It uses the global tracer
+// provider, which is a no-op unless setupTracing has been called.
+var tracer = otel.Tracer("github.com/timescale/pg-logfire")
+
+// setupTracing exports spans to the OTLP/HTTP endpoint at the given URL, e.g.
+// http://localhost:4318/v1/traces. The returned function flushes and stops the exporter.
+func setupTracing(ctx context.Context, endpoint string, serviceName string) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// endSpan ends the given span, marking it as failed when err is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+type requestIDCtxKey struct{}
+
+type sessionRequestIDCtxKey struct{}
+
+// newUUID returns a new random (version 4) UUID.
+func newUUID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	id[6] = id[6]&0x0f | 0x40 // Version 4
+	id[8] = id[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
+
+// withRequestID returns a context carrying a new random UUID identifying a query, which is sent to the
+// Logfire API with every request made for the query, including retries. It also carries the session
+// request ID of the query, <session ID>/<number of the query in the session>, which tells apart the
+// sessions queries were sent by.
+func withRequestID(ctx context.Context) (context.Context, string, string) {
+	requestID := newUUID()
+	state := getSessionState(ctx)
+	sessionRequestID := fmt.Sprintf("%s/%d", state.id, state.querySeq.Add(1))
+
+	ctx = context.WithValue(ctx, requestIDCtxKey{}, requestID)
+	ctx = context.WithValue(ctx, sessionRequestIDCtxKey{}, sessionRequestID)
+	return ctx, requestID, sessionRequestID
+}
+
+// setCorrelationHeaders sets the X-Request-ID and X-Logfire-PG-Request-ID headers of a request to the
+// Logfire API to the request IDs of the given context, and the traceparent header to its span when
+// tracing is enabled, so that the logs and traces of both sides can be correlated.
+func setCorrelationHeaders(ctx context.Context, header http.Header) {
+	if requestID, ok := ctx.Value(requestIDCtxKey{}).(string); ok {
+		header.Set("X-Request-ID", requestID)
+	}
+	if sessionRequestID, ok := ctx.Value(sessionRequestIDCtxKey{}).(string); ok {
+		header.Set("X-Logfire-PG-Request-ID", sessionRequestID)
+	}
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(header))
+}
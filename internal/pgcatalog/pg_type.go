@@ -0,0 +1,66 @@
+// Package pgcatalog holds the rows of the PostgreSQL system catalogs emulated by logfire-pg, which
+// clients such as psql and pgAdmin read to describe results.
+package pgcatalog
+
+import "github.com/lib/pq/oid"
+
+// Type categories of pg_type.typcategory.
+const (
+	CategoryArray       = 'A'
+	CategoryBoolean     = 'B'
+	CategoryDateTime    = 'D'
+	CategoryNumeric     = 'N'
+	CategoryString      = 'S'
+	CategoryTimespan    = 'T'
+	CategoryUserDefined = 'U'
+)
+
+// Type is a row of pg_catalog.pg_type.
+type Type struct {
+	OID  oid.Oid
+	Name string
+	// Len is the size of a value in bytes, or -1 for variable-length types.
+	Len      int
+	ByVal    bool
+	Category byte
+	// Elem is the element type of an array type, Array the array type of an element type.
+	Elem  oid.Oid
+	Array oid.Oid
+}
+
+// Types lists the types logfire-pg returns values as, and their array types.
+var Types = []Type{
+	{OID: oid.T_bool, Name: "bool", Len: 1, ByVal: true, Category: CategoryBoolean, Array: oid.T__bool},
+	{OID: oid.T_bytea, Name: "bytea", Len: -1, Category: CategoryUserDefined, Array: oid.T__bytea},
+	{OID: oid.T_int8, Name: "int8", Len: 8, ByVal: true, Category: CategoryNumeric, Array: oid.T__int8},
+	{OID: oid.T_int2, Name: "int2", Len: 2, ByVal: true, Category: CategoryNumeric, Array: oid.T__int2},
+	{OID: oid.T_int4, Name: "int4", Len: 4, ByVal: true, Category: CategoryNumeric, Array: oid.T__int4},
+	{OID: oid.T_text, Name: "text", Len: -1, Category: CategoryString, Array: oid.T__text},
+	{OID: oid.T_json, Name: "json", Len: -1, Category: CategoryUserDefined, Array: oid.T__json},
+	{OID: oid.T_float4, Name: "float4", Len: 4, ByVal: true, Category: CategoryNumeric, Array: oid.T__float4},
+	{OID: oid.T_float8, Name: "float8", Len: 8, ByVal: true, Category: CategoryNumeric, Array: oid.T__float8},
+	{OID: oid.T_date, Name: "date", Len: 4, ByVal: true, Category: CategoryDateTime, Array: oid.T__date},
+	{OID: oid.T_time, Name: "time", Len: 8, ByVal: true, Category: CategoryDateTime, Array: oid.T__time},
+	{OID: oid.T_timestamptz, Name: "timestamptz", Len: 8, ByVal: true, Category: CategoryDateTime, Array: oid.T__timestamptz},
+	{OID: oid.T_interval, Name: "interval", Len: 16, Category: CategoryTimespan, Array: oid.T__interval},
+	{OID: oid.T_numeric, Name: "numeric", Len: -1, Category: CategoryNumeric, Array: oid.T__numeric},
+	{OID: oid.T_uuid, Name: "uuid", Len: 16, Category: CategoryUserDefined, Array: oid.T__uuid},
+	{OID: oid.T_jsonb, Name: "jsonb", Len: -1, Category: CategoryUserDefined, Array: oid.T__jsonb},
+
+	{OID: oid.T__bool, Name: "_bool", Len: -1, Category: CategoryArray, Elem: oid.T_bool},
+	{OID: oid.T__bytea, Name: "_bytea", Len: -1, Category: CategoryArray, Elem: oid.T_bytea},
+	{OID: oid.T__int8, Name: "_int8", Len: -1, Category: CategoryArray, Elem: oid.T_int8},
+	{OID: oid.T__int2, Name: "_int2", Len: -1, Category: CategoryArray, Elem: oid.T_int2},
+	{OID: oid.T__int4, Name: "_int4", Len: -1, Category: CategoryArray, Elem: oid.T_int4},
+	{OID: oid.T__text, Name: "_text", Len: -1, Category: CategoryArray, Elem: oid.T_text},
+	{OID: oid.T__json, Name: "_json", Len: -1, Category: CategoryArray, Elem: oid.T_json},
+	{OID: oid.T__float4, Name: "_float4", Len: -1, Category: CategoryArray, Elem: oid.T_float4},
+	{OID: oid.T__float8, Name: "_float8", Len: -1, Category: CategoryArray, Elem: oid.T_float8},
+	{OID: oid.T__date, Name: "_date", Len: -1, Category: CategoryArray, Elem: oid.T_date},
+	{OID: oid.T__time, Name: "_time", Len: -1, Category: CategoryArray, Elem: oid.T_time},
+	{OID: oid.T__timestamptz, Name: "_timestamptz", Len: -1, Category: CategoryArray, Elem: oid.T_timestamptz},
+	{OID: oid.T__interval, Name: "_interval", Len: -1, Category: CategoryArray, Elem: oid.T_interval},
+	{OID: oid.T__numeric, Name: "_numeric", Len: -1, Category: CategoryArray, Elem: oid.T_numeric},
+	{OID: oid.T__uuid, Name: "_uuid", Len: -1, Category: CategoryArray, Elem: oid.T_uuid},
+	{OID: oid.T__jsonb, Name: "_jsonb", Len: -1, Category: CategoryArray, Elem: oid.T_jsonb},
+}